@@ -9,16 +9,25 @@ file system (DFS) system to be used in assignment 2 of UBC CS 416
 package dfslib
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/rpc"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 	"unicode"
-	//    "strings"
-	"path/filepath"
 
 	"../shared"
 )
@@ -26,6 +35,18 @@ import (
 // A Chunk is the unit of reading/writing in DFS.
 type Chunk [32]byte
 
+// Limits on the chunk size a file can be created with.
+const (
+	// Chunk size of files opened with Open.
+	DefaultChunkSize = len(Chunk{})
+
+	// Smallest chunk size a file can have.
+	MinChunkSize = len(Chunk{})
+
+	// Largest chunk size a file can have.
+	MaxChunkSize = 1 << 20
+)
+
 // Represents a type of file access.
 type FileMode int
 
@@ -38,6 +59,16 @@ const (
 
 	// Disconnected read mode.
 	DREAD
+
+	// Chunk write mode: several clients can write to the file at
+	// once, each only to chunks it locked with LockChunks.
+	CWRITE
+
+	// Disconnected write mode: works on the local copy like DREAD,
+	// connected or not. Writes are kept aside and published by
+	// Reconcile, which MountDFS runs, unless another client wrote
+	// the same chunks first.
+	DWRITE
 )
 
 ////////////////////////////////////////////////////////////////////////////////////////////
@@ -59,10 +90,10 @@ func (e DisconnectedError) Error() string {
 }
 
 // Contains chunkNum that is unavailable
-type ChunkUnavailableError uint8
+type ChunkUnavailableError uint32
 
 func (e ChunkUnavailableError) Error() string {
-	return fmt.Sprintf("DFS: Latest verson of chunk [%s] unavailable", string(e))
+	return fmt.Sprintf("DFS: Latest verson of chunk [%d] unavailable", uint32(e))
 }
 
 // Contains filename
@@ -114,6 +145,55 @@ func (e FileDoesNotExistError) Error() string {
 	return fmt.Sprintf("DFS: Cannot open file [%s] in D mode as it does not exist locally", string(e))
 }
 
+// Contains directory path
+type DirectoryDoesNotExistError string
+
+func (e DirectoryDoesNotExistError) Error() string {
+	return fmt.Sprintf("DFS: Directory [%s] does not exist", string(e))
+}
+
+// Contains directory path
+type DirectoryNotEmptyError string
+
+func (e DirectoryNotEmptyError) Error() string {
+	return fmt.Sprintf("DFS: Directory [%s] is not empty", string(e))
+}
+
+// Contains filename
+type FileNotFoundError string
+
+func (e FileNotFoundError) Error() string {
+	return fmt.Sprintf("DFS: Filename [%s] does not exist", string(e))
+}
+
+// Contains filename
+type FileExistsError string
+
+func (e FileExistsError) Error() string {
+	return fmt.Sprintf("DFS: Filename [%s] already exists", string(e))
+}
+
+// Contains chunk size
+type BadChunkSizeError int
+
+func (e BadChunkSizeError) Error() string {
+	return fmt.Sprintf("DFS: Chunk size [%d] is not supported by this file", int(e))
+}
+
+// Contains filename
+type ChunkLockConflictError string
+
+func (e ChunkLockConflictError) Error() string {
+	return fmt.Sprintf("DFS: Chunks of filename [%s] are locked for writing by another client", string(e))
+}
+
+// Contains chunkNum that is not locked
+type ChunkNotLockedError uint32
+
+func (e ChunkNotLockedError) Error() string {
+	return fmt.Sprintf("DFS: Chunk [%d] is not locked for writing", uint32(e))
+}
+
 // </ERROR DEFINITIONS>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
@@ -125,19 +205,136 @@ type DFSFile interface {
 	// Can return the following errors:
 	// - DisconnectedError (in READ,WRITE modes)
 	// - ChunkUnavailableError (in READ,WRITE modes)
-	Read(chunkNum uint8, chunk *Chunk) (err error)
+	Read(chunkNum uint32, chunk *Chunk) (err error)
 
 	// Writes chunk number chunkNum from storage pointed to by
 	// chunk. Returns a non-nil error if the write was unsuccessful.
+	// In DWRITE mode the write waits for Reconcile to be published.
+	//
+	// Can return the following errors:
+	// - BadFileModeError (in READ,DREAD modes)
+	// - DisconnectedError (in WRITE,CWRITE modes)
+	// - WriteModeTimeoutError (in WRITE,CWRITE modes, if the write lease or chunk lock ran out)
+	// - ChunkNotLockedError (in CWRITE mode)
+	// - LocalPathError (in DWRITE mode, if the write could not be saved)
+	Write(chunkNum uint32, chunk *Chunk) (err error)
+
+	// Returns the number of bytes in each chunk of the file.
+	ChunkSize() int
+
+	// Like Read, but reads into buf which must be exactly ChunkSize()
+	// bytes long. Read and Write only work on files whose chunk size
+	// is the size of a Chunk.
+	//
+	// Can return the following errors:
+	// - DisconnectedError (in READ,WRITE modes)
+	// - ChunkUnavailableError (in READ,WRITE modes)
+	// - BadChunkSizeError
+	ReadChunk(chunkNum uint32, buf []byte) (err error)
+
+	// Like Write, but writes buf which must be exactly ChunkSize()
+	// bytes long.
 	//
 	// Can return the following errors:
 	// - BadFileModeError (in READ,DREAD modes)
-	// - DisconnectedError (in WRITE mode)
-	Write(chunkNum uint8, chunk *Chunk) (err error)
+	// - DisconnectedError (in WRITE,CWRITE modes)
+	// - WriteModeTimeoutError (in WRITE,CWRITE modes, if the write lease or chunk lock ran out)
+	// - ChunkNotLockedError (in CWRITE mode)
+	// - LocalPathError (in DWRITE mode, if the write could not be saved)
+	// - BadChunkSizeError
+	WriteChunk(chunkNum uint32, buf []byte) (err error)
+
+	// Locks chunks first to last (inclusive) for writing through this
+	// file. Other clients can lock and write other chunks at the
+	// same time. The lock is kept until UnlockChunks or Close.
+	//
+	// Can return the following errors:
+	// - BadFileModeError (in READ,WRITE,DREAD,DWRITE modes)
+	// - ChunkLockConflictError (if another client has some of the chunks locked or is waiting for WRITE mode, or any client, this one too, has the file open in WRITE mode)
+	// - ChunkNotLockedError (if first is after last)
+	// - DisconnectedError
+	LockChunks(first uint32, last uint32) (err error)
+
+	// Releases the locks taken through this file that lie within
+	// chunks first to last.
+	//
+	// Can return the following errors:
+	// - BadFileModeError (in READ,WRITE,DREAD,DWRITE modes)
+	// - DisconnectedError
+	UnlockChunks(first uint32, last uint32) (err error)
 
 	// Closes the file/cleans up. Can return the following errors:
 	// - DisconnectedError
 	Close() (err error)
+
+	// Like Read, Write and Close, but give up waiting for the server
+	// when ctx is done and return ctx.Err() (context.Canceled or
+	// context.DeadlineExceeded).
+	ReadContext(ctx context.Context, chunkNum uint32, chunk *Chunk) (err error)
+	WriteContext(ctx context.Context, chunkNum uint32, chunk *Chunk) (err error)
+	CloseContext(ctx context.Context) (err error)
+}
+
+// Information about a file returned by Stat.
+type FileInfo struct {
+	Name      string // Path of the file
+	Size      int64  // Length in bytes, rounded up to a whole chunk unless the local copy is fresh
+	ChunkSize int    // Bytes per chunk
+
+	// Filled in only when connected
+	Connected bool                      // False if the info only comes from the local copy
+	Versions  map[uint32]int            // Latest version of each chunk written
+	Holders   map[string]map[uint32]int // Versions of each chunk held by each client, keyed by local path, "#n" added if clients share one
+	Writer    string                    // Local path of the client writing to the file, "" if none
+
+	// Local copy
+	Local         bool           // True if this client has a copy of the file
+	LocalVersions map[uint32]int // Versions of each chunk in the local copy
+	Fresh         bool           // True if the local copy has the latest version of every chunk
+}
+
+// Write to a watched file, sent on the channel returned by Watch.
+type ChangeEvent struct {
+	Name    string // Path of the file written
+	Chunk   uint32 // Chunk number written
+	Version int    // New version of the chunk
+	Writer  string // Local path of the client that wrote the chunk
+}
+
+// Entry of a directory listing.
+type DirEntry struct {
+	Name  string // Name within the directory
+	IsDir bool   // True for directories, false for files
+}
+
+// Chunk whose latest version has fewer live copies than the server's
+// replication factor asks for, returned by UnderReplicated.
+type ChunkReplicas struct {
+	Name     string // Path of the file
+	Chunk    uint32 // Chunk number
+	Version  int    // Latest version of the chunk
+	Replicas int    // Clients holding the latest version, including its writer
+	Live     int    // Clients among them that are connected and sending heartbeats
+}
+
+// Write made in DWRITE mode that was not published because another
+// client wrote the chunk since, returned by Reconcile.
+type WriteConflict struct {
+	Name   string // Path of the file
+	Chunk  uint32 // Chunk number
+	Base   int    // Version of the chunk the write was made against
+	Latest int    // Version another client wrote since
+	Data   []byte // Chunk as written in DWRITE mode
+}
+
+// Progress of the server's repairs, returned by RepairStatus.
+type RepairStatus struct {
+	Backlog     int       // Chunks below the replication factor at the last scan
+	Unavailable int       // Chunks among them with no live copy, repaired once a holder comes back
+	Queued      int       // Repairs waiting to be made
+	Repaired    int       // Copies made by repairs since the server started
+	Failed      int       // Repairs that could not make every copy needed
+	LastScan    time.Time // When the server last looked for chunks to repair, zero if it doesn't repair
 }
 
 // Represents a connection to the DFS system.
@@ -146,13 +343,13 @@ type DFS interface {
 	// available for DREAD reads).
 	//
 	// Can return the following errors:
-	// - BadFilenameError (if filename contains non alpha-numeric chars or is not 1-16 chars long)
+	// - BadFilenameError (if a path component contains non alpha-numeric chars or is not 1-16 chars long)
 	LocalFileExists(fname string) (exists bool, err error)
 
 	// Check if a file with filename fname exists globally.
 	//
 	// Can return the following errors:
-	// - BadFilenameError (if filename contains non alpha-numeric chars or is not 1-16 chars long)
+	// - BadFilenameError (if a path component contains non alpha-numeric chars or is not 1-16 chars long)
 	// - DisconnectedError
 	GlobalFileExists(fname string) (exists bool, err error)
 
@@ -165,10 +362,165 @@ type DFS interface {
 	// - OpenWriteConflictError (in WRITE mode)
 	// - DisconnectedError (in READ,WRITE modes)
 	// - FileUnavailableError (in READ,WRITE modes)
-	// - FileDoesNotExistError (in DREAD mode)
-	// - BadFilenameError (if filename contains non alpha-numeric chars or is not 1-16 chars long)
+	// - FileDoesNotExistError (in DREAD,DWRITE modes)
+	// - BadFilenameError (if a path component contains non alpha-numeric chars or is not 1-16 chars long)
 	Open(fname string, mode FileMode) (f DFSFile, err error)
 
+	// Like Open, but a file that does not exist yet is created with
+	// chunkSize bytes per chunk instead of DefaultChunkSize. Existing
+	// files keep the chunk size they were created with.
+	//
+	// Can return the same errors as Open, and:
+	// - BadChunkSizeError (if chunkSize is not between MinChunkSize and MaxChunkSize)
+	OpenWithChunkSize(fname string, mode FileMode, chunkSize int) (f DFSFile, err error)
+
+	// Like LocalFileExists, GlobalFileExists and Open, but give up
+	// waiting for the server when ctx is done and return ctx.Err()
+	// (context.Canceled or context.DeadlineExceeded). Write access
+	// granted to an abandoned Open is given back.
+	LocalFileExistsContext(ctx context.Context, fname string) (exists bool, err error)
+	GlobalFileExistsContext(ctx context.Context, fname string) (exists bool, err error)
+	OpenContext(ctx context.Context, fname string, mode FileMode) (f DFSFile, err error)
+
+	// Like OpenContext, but in WRITE mode waits for the client
+	// writing to fname to close it instead of returning
+	// OpenWriteConflictError. Waiting clients get the file in the
+	// order they asked for it. Use a ctx with a deadline to wait for
+	// a limited time, or cancel ctx to stop waiting.
+	//
+	// Can return the same errors as Open except
+	// OpenWriteConflictError, and ctx.Err().
+	OpenWait(ctx context.Context, fname string, mode FileMode) (f DFSFile, err error)
+
+	// Creates directory dir. Files and directories are named by
+	// slash separated paths, ie: "projects/dfs/notes". The parent of
+	// dir must already exist. Creating a directory that exists is
+	// not an error.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if a path component contains non alpha-numeric chars, is not 1-16 chars long or dir names a file)
+	// - DirectoryDoesNotExistError (if the parent directory does not exist)
+	// - DisconnectedError
+	Mkdir(dir string) (err error)
+
+	// Lists the files and directories directly inside dir, sorted by
+	// name. dir is "" for the root.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if a path component contains non alpha-numeric chars or is not 1-16 chars long)
+	// - DirectoryDoesNotExistError
+	// - DisconnectedError
+	ReadDir(dir string) (entries []DirEntry, err error)
+
+	// Removes the empty directory dir.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if a path component contains non alpha-numeric chars or is not 1-16 chars long)
+	// - DirectoryDoesNotExistError
+	// - DirectoryNotEmptyError
+	// - DisconnectedError
+	Rmdir(dir string) (err error)
+
+	// Removes file fname from the DFS. Local copies on every client
+	// are deleted, clients that are disconnected delete theirs when
+	// they next mount.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if a path component contains non alpha-numeric chars or is not 1-16 chars long)
+	// - FileNotFoundError
+	// - OpenWriteConflictError (if a client has the file open in WRITE mode)
+	// - DisconnectedError
+	Remove(fname string) (err error)
+
+	// Returns information about file fname. When disconnected only
+	// the local copy is described and info.Connected is false.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if a path component contains non alpha-numeric chars or is not 1-16 chars long)
+	// - FileNotFoundError
+	Stat(fname string) (info *FileInfo, err error)
+
+	// Lists files in the DFS whose path starts with prefix, sorted by
+	// path. At most limit names are returned (all of them if limit <=
+	// 0), starting after the path after. To page through the files
+	// pass the last path of one page as after for the next.
+	//
+	// Can return the following errors:
+	// - DisconnectedError
+	ListGlobalFiles(prefix string, after string, limit int) (names []string, err error)
+
+	// Lists files that have a copy in the local path (i.e., available
+	// for DREAD reads), sorted by path.
+	//
+	// Can return the following errors:
+	// - LocalPathError
+	ListLocalFiles() (names []string, err error)
+
+	// Renames file oldName to newName. Local copies on every client
+	// are renamed, clients that are disconnected rename theirs when
+	// they next mount.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if a path component contains non alpha-numeric chars or is not 1-16 chars long)
+	// - FileNotFoundError (if oldName does not exist)
+	// - FileExistsError (if newName is already a file or directory)
+	// - DirectoryDoesNotExistError (if the directory of newName does not exist)
+	// - OpenWriteConflictError (if a client has the file open in WRITE mode)
+	// - DisconnectedError
+	Rename(oldName string, newName string) (err error)
+
+	// Returns a channel that receives an event every time a client
+	// writes a chunk of fname, including writes made through this
+	// dfs. Events are dropped if the channel is not read quickly
+	// enough, compare Version with the one last seen to detect a gap.
+	// The watch follows the file when it is renamed. The channel is
+	// closed when the file is removed and by UMountDFS. Watching a
+	// file that does not exist yet is allowed.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if a path component contains non alpha-numeric chars or is not 1-16 chars long)
+	// - DisconnectedError
+	Watch(fname string) (events <-chan ChangeEvent, err error)
+
+	// Lists the chunks whose latest version is held by fewer live
+	// clients than the server's replication factor asks for, sorted
+	// by file and chunk number. A server started without a
+	// replication factor wants one copy, so only chunks no live
+	// client holds are listed.
+	//
+	// Can return the following errors:
+	// - DisconnectedError
+	UnderReplicated() (chunks []ChunkReplicas, err error)
+
+	// Returns how far the server is from copying every chunk listed
+	// by UnderReplicated to enough live clients.
+	//
+	// Can return the following errors:
+	// - DisconnectedError
+	RepairStatus() (status *RepairStatus, err error)
+
+	// Publishes the writes made in DWRITE mode. Writes to chunks
+	// another client wrote since are returned as conflicts, with the
+	// data written, and dropped, so each is only returned once. The
+	// Reconcile that MountDFS runs keeps them for the app's next
+	// Reconcile. Files another client is writing are left for a
+	// later Reconcile.
+	//
+	// Can return the following errors:
+	// - OpenWriteConflictError (if another client is writing to a file)
+	// - FileNotFoundError (if a file was removed from the DFS)
+	// - LocalPathError
+	// - DisconnectedError
+	Reconcile() (conflicts []WriteConflict, err error)
+
+	// Drops the writes made to fname in DWRITE mode that are not
+	// published yet.
+	//
+	// Can return the following errors:
+	// - BadFilenameError (if a path component contains non alpha-numeric chars or is not 1-16 chars long)
+	// - LocalPathError
+	DiscardWrites(fname string) (err error)
+
 	// Disconnects from the server. Can return the following errors:
 	// - DisconnectedError
 	UMountDFS() (err error)
@@ -187,336 +539,1968 @@ func isAlphaNumeric(fname string) bool {
 	return true
 }
 
-// </CONCRETE TYPE>
-////////////////////////////////////////////////////////////////////////////////////////////
-
-// DFSInstance will do the RPC call using client.call("DFSServer.Method", args, reply)
-type DFSInstance struct {
-	Client      *rpc.Client // To call server
-	Server      *rpc.Server // To receive msgs from server
-	LocalPath   string
-	IPAddr      string
-	ServerAddr  string
-	Connected   bool
-	Heartbeat   *net.UDPConn
-	FilesOpened []*OpenFile
-}
-
-func (dfs *DFSInstance) SendUDPHeartbeat(fname string) (exists bool, err error) {
-	addr, _ := net.ResolveUDPAddr("udp", dfs.ServerAddr)
-	myaddr, _ := net.ResolveUDPAddr("udp", dfs.IPAddr)
-
-	conn, err := net.DialUDP("udp", myaddr, addr)
-	dfs.Heartbeat = conn
-
-	for {
-		currentTime := time.Now()
-		beat := &shared.Heartbeat{
-			LocalPath: dfs.LocalPath,
-			TimeSent:  currentTime,
-		}
-		msg, err := json.Marshal(beat)
-		if err != nil {
-			//fmt.Println("Error marshaling data")
+// Returns true if path is slash separated names of 1-16 alphanumeric chars
+// ie: "notes", "projects/dfs/notes"
+// "log" is reserved, the client's log is kept as log.dfs
+func isValidPath(path string) bool {
+	if path == "log" {
+		return false
+	}
+	for _, name := range strings.Split(path, "/") {
+		if len(name) < 1 || len(name) > 16 || !isAlphaNumeric(name) {
+			return false
 		}
+	}
+	return true
+}
 
-		//	msg := []byte("Hello there")
-
-		_, err = conn.Write(msg)
-		if err != nil {
-			//fmt.Println("Error writing to UDP Conn")
+// Returns true if list contains s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
 		}
+	}
+	return false
+}
 
-		time.Sleep((2*time.Second - time.Since(currentTime)) * time.Second)
+// Returns the directory containing path, "" for the root
+func parentDir(path string) string {
+	index := strings.LastIndex(path, "/")
+	if index < 0 {
+		return ""
 	}
+	return path[:index]
 }
 
-// Return true if file is on disk, else return false
-func (dfs *DFSInstance) LocalFileExists(fname string) (exists bool, err error) {
-	// Check arguments
-	nameLength := len(fname)
-	if nameLength < 1 || nameLength > 16 {
-		return false, BadFilenameError(fname)
+// Makes an rpc call that gives up when ctx is done
+// The call itself can't be cancelled, so it decodes into its own reply that is only
+// copied to reply if it finishes in time
+func call(ctx context.Context, client *rpc.Client, method string, args interface{}, reply *shared.Reply) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
 	}
-	if !isAlphaNumeric(fname) {
-		return false, BadFilenameError(fname)
+	var callReply shared.Reply
+	c := client.Go(method, args, &callReply, make(chan *rpc.Call, 1))
+	select {
+	case <-c.Done:
+		*reply = callReply
+		return c.Error
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	// Check if file exists, needs .dfs ext
-	ext := fmt.Sprintf("%s.dfs", fname)
-	file := filepath.Join(dfs.LocalPath, ext)
+// Returns path of the metadata file kept next to fname's chunks
+func metadataPath(localPath string, fname string) string {
+	return filepath.Join(localPath, fmt.Sprintf("%s.meta", fname))
+}
 
-	_, err = os.Stat(file)
+// Reads the metadata saved for fname in localPath
+func readMetadata(localPath string, fname string) (meta *shared.FileMetadata, err error) {
+	data, err := ioutil.ReadFile(metadataPath(localPath, fname))
 	if err != nil {
-		return false, nil
+		return nil, err
 	}
-	return true, nil
+	meta = &shared.FileMetadata{}
+	err = json.Unmarshal(data, meta)
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
 }
 
-// Return true if file exists, else return false
-func (dfs *DFSInstance) GlobalFileExists(fname string) (exists bool, err error) {
-	// Check arguments
-	nameLength := len(fname)
-	if nameLength < 1 || nameLength > 16 {
-		return false, BadFilenameError(fname)
-	}
-	if !isAlphaNumeric(fname) {
-		return false, BadFilenameError(fname)
+// Saves the metadata of a file in localPath
+func writeMetadata(localPath string, meta *shared.FileMetadata) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
 	}
+	return ioutil.WriteFile(metadataPath(localPath, meta.Name), data, 0644)
+}
 
-	var reply shared.Reply
-	args := &shared.Args{
-		Filename: fname,
-	}
+// File in a local path holding the uuid of the client using it
+const uuidFile = "client.id"
 
-	err = dfs.Client.Call("DFSServerInstance.GlobalFileExists", args, &reply)
+// Returns the uuid of the client using localPath, made and saved on its first mount
+func clientUUID(localPath string) (string, error) {
+	path := filepath.Join(localPath, uuidFile)
+	data, err := ioutil.ReadFile(path)
+	if uuid := strings.TrimSpace(string(data)); err == nil && uuid != "" {
+		return uuid, nil
+	}
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
 	if err != nil {
-		//fmt.Println("this is the error from global file exists: ", err)
+		return "", err
 	}
-	return reply.Exists, nil
-	//return false, nil
+	id[6] = id[6]&0x0f | 0x40 // Version 4
+	id[8] = id[8]&0x3f | 0x80 // RFC 4122 variant
+	uuid := fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+	return uuid, ioutil.WriteFile(path, []byte(uuid), 0644)
 }
 
-// Client call to open a file for reading and writing
-// Opens the file if already there otherwise creates one
-func (dfs *DFSInstance) Open(fname string, mode FileMode) (f DFSFile, err error) {
+// Chunk written in DWRITE mode and not published yet
+type pendingWrite struct {
+	Base int    // Version of the chunk the write was made against
+	Data []byte // Chunk as written
+}
 
-	// Check validity of fname
-	nameLength := len(fname)
-	if nameLength < 1 || nameLength > 16 {
-		return nil, BadFilenameError(fname)
+// Returns path of the journal of fname's DWRITE writes
+func pendingPath(localPath string, fname string) string {
+	return filepath.Join(localPath, fmt.Sprintf("%s.pending", fname))
+}
+
+// Reads the DWRITE writes of fname, a file without a journal has none
+func readPending(localPath string, fname string) (map[uint32]*pendingWrite, error) {
+	pending := make(map[uint32]*pendingWrite)
+	data, err := ioutil.ReadFile(pendingPath(localPath, fname))
+	if os.IsNotExist(err) {
+		return pending, nil
+	} else if err != nil {
+		return nil, err
 	}
-	if !isAlphaNumeric(fname) {
-		return nil, BadFilenameError(fname)
+	err = json.Unmarshal(data, &pending)
+	if err != nil {
+		return nil, err
 	}
+	return pending, nil
+}
 
-	var file *os.File
-	var fileToChange *os.File
-	var versions [256]int
+// Saves the DWRITE writes of fname, the journal is removed once they are all published
+func writePending(localPath string, fname string, pending map[uint32]*pendingWrite) error {
+	if len(pending) == 0 {
+		err := os.Remove(pendingPath(localPath, fname))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pendingPath(localPath, fname), data, 0644)
+}
 
-	// Get full path of file
-	ext := fmt.Sprintf("%s.dfs", fname)
-	fullFilename := filepath.Join(dfs.LocalPath, ext)
+// Write in WRITE or CWRITE mode the log doesn't show as complete or reverted
+type loggedWrite struct {
+	Name     string
+	Chunk    uint32
+	Base     int    // Version of the chunk the write was made against
+	OldSize  int64  // Size of the local copy before the write
+	Old      []byte // What the chunk held before the write
+	Data     []byte // Chunk as written
+	Updating bool   // True once the chunk is written locally and the server is being told
+}
 
-	// Check if file exists locally
-	exists, _ := dfs.LocalFileExists(fullFilename)
+// Returns path of the log of writes in WRITE and CWRITE mode
+func logPath(localPath string) string {
+	return filepath.Join(localPath, "log.dfs")
+}
 
-	// If DREAD, return FileDoesNotExistError if file doesnt exist
-	if mode == DREAD {
-		if !exists {
-			return nil, FileDoesNotExistError(fname)
-		}
-	} else if mode == READ || mode == WRITE {
-		//If disconnected return DisconnectedError
-		if !dfs.Connected {
-			return nil, DisconnectedError(dfs.ServerAddr)
-		}
+// Size the write log grows to before it is cut down to the writes not complete yet,
+// on top of twice what those writes took after the last cut, as each holds two chunks
+const maxLogSize = 1 << 20
 
-		// If mode == WRITE and somebody is already writing to file, return OpenWriteConflict
-		// Otherwise tell server we're writing
-		if mode == WRITE {
-			var reply shared.Reply
-			args := &shared.Args{
-				LocalPath: dfs.LocalPath,
-				Filename:  fname,
-				Mode:      int(mode),
-			}
-			_ = dfs.Client.Call("DFSServerInstance.Writeable", args, &reply)
-			if !reply.Writeable {
-				return nil, OpenWriteConflictError(fname)
-			}
-		}
+// Returns the log lines of a write not complete yet
+func (w *loggedWrite) lines() string {
+	lines := fmt.Sprintf("WRITING: %d, %s, %d, %d, %s, %s\n", w.Chunk, w.Name, w.Base, w.OldSize,
+		base64.StdEncoding.EncodeToString(w.Old), base64.StdEncoding.EncodeToString(w.Data))
+	if w.Updating {
+		lines += fmt.Sprintf("SERVER FILES UPDATING: %d, %s\n", w.Chunk, w.Name)
+	}
+	return lines
+}
 
-		// Check if log file exists. If not, create and tell server
-		logFilePath := filepath.Join(dfs.LocalPath, "log.dfs")
-		logFileExists, _ := dfs.LocalFileExists(logFilePath)
+// Reads the writes the log of localPath doesn't show as complete or reverted, in the order they were made
+// Lines a crash cut short, or written before writes were logged in full, are skipped
+func readLog(localPath string) ([]*loggedWrite, error) {
+	data, err := ioutil.ReadFile(logPath(localPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		if !logFileExists {
-			// Create the file
-			logFileName := filepath.Join(dfs.LocalPath, "log.dfs")
-			log, err := os.Create(logFileName)
-			log.Sync()
+	type chunkKey struct {
+		name  string
+		chunk uint32
+	}
+	open := make(map[chunkKey]*loggedWrite)
+	var writes []*loggedWrite
+	for _, line := range strings.Split(string(data), "\n") {
+		var prefix string
+		for _, p := range []string{"WRITING: ", "SERVER FILES UPDATING: ", "WRITE COMPLETE: ", "WRITE REVERTED: "} {
+			if strings.HasPrefix(line, p) {
+				prefix = p
+			}
+		}
+		fields := strings.Split(strings.TrimPrefix(line, prefix), ", ")
+		if prefix == "" || len(fields) < 2 {
+			continue
+		}
+		chunk, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			continue
+		}
+		key := chunkKey{fields[1], uint32(chunk)}
 
-			var reply shared.Reply
-			args := &shared.Args{
-				Filename:  "log",
-				LocalPath: dfs.LocalPath,
-				Versions:  versions,
+		switch prefix {
+		case "WRITING: ":
+			if len(fields) != 6 {
+				continue
 			}
-			// Update server that file exists
-			err = dfs.Client.Call("DFSServerInstance.UpdateServer", args, &reply)
-			if err != nil {
-				//fmt.Println("Could not update server") //delete
+			w := &loggedWrite{Name: key.name, Chunk: key.chunk}
+			base, err1 := strconv.Atoi(fields[2])
+			oldSize, err2 := strconv.ParseInt(fields[3], 10, 64)
+			old, err3 := base64.StdEncoding.DecodeString(fields[4])
+			written, err4 := base64.StdEncoding.DecodeString(fields[5])
+			if err1 != nil || err2 != nil || err3 != nil || err4 != nil || len(written) == 0 {
+				continue
 			}
+			w.Base, w.OldSize, w.Old, w.Data = base, oldSize, old, written
+			open[key] = w
+			writes = append(writes, w)
+		case "SERVER FILES UPDATING: ":
+			if w, exists := open[key]; exists {
+				w.Updating = true
+			}
+		default:
+			delete(open, key)
 		}
+	}
 
-		// Check if global file exists and if client with file connected.
-		//If not, return FileUnavailableError
-		var reply shared.Reply
-		args := &shared.Args{
-			Filename:  fname,
-			LocalPath: dfs.LocalPath,
+	// A later write to the chunk replaces an earlier one
+	var incomplete []*loggedWrite
+	for _, w := range writes {
+		if open[chunkKey{w.Name, w.Chunk}] == w {
+			incomplete = append(incomplete, w)
 		}
-		err = dfs.Client.Call("DFSServerInstance.GlobalFileExists", args, &reply)
-		globalExists := reply.Exists
+	}
+	return incomplete, nil
+}
 
-		// If local file doesn't exist, create it
-		if !exists {
-			// Create the file
-			fileToChange, err = os.Create(fullFilename)
-			//fileToChange.Truncate(int64(256 * 32))
-			fileToChange.Sync()
-			fileToChange.Close()
+// </CONCRETE TYPE>
+////////////////////////////////////////////////////////////////////////////////////////////
 
-			var reply shared.Reply
-			args := &shared.Args{
-				Filename:  fname,
-				LocalPath: dfs.LocalPath,
-				Versions:  versions,
-			}
-			// Update server that file exists
-			err = dfs.Client.Call("DFSServerInstance.UpdateServer", args, &reply)
-			if err != nil {
-				//fmt.Println("Could not update server") //delete
+// DFSInstance will do the RPC call using client.call("DFSServer.Method", args, reply)
+// Each mount owns its connections and goroutines, so several can be used at once
+type DFSInstance struct {
+	Client      *rpc.Client  // To call server, replaced when the mount fails over to another server
+	Server      *rpc.Server  // To receive msgs from server
+	Listener    net.Listener // Where Server accepts connections from the server
+	LocalPath   string
+	IPAddr      string
+	ServerAddr  string
+	Connected   bool
+	Heartbeat   *net.UDPConn
+	FilesOpened []*OpenFile
+	Servers     []string // Servers to fail over to, primary first
+	UUID        string   // Kept in LocalPath so servers know the mount when it mounts again
+
+	conns    []net.Conn                    // Connections accepted by Listener
+	tickets  uint64                        // Last ticket used to wait for write access
+	watchers map[string][]chan ChangeEvent // Channels returned by Watch for each file
+	done     chan struct{}                 // Closed by UMountDFS to stop this mount's goroutines
+	mutex    sync.Mutex                    // Protects FilesOpened, conns and watchers
+
+	seeds       []string     // Servers given to MountDFS
+	name        string       // Name the server knows the mount by, LocalPath unless another client had it
+	serverMutex sync.RWMutex // Protects Client, ServerAddr, Servers, Connected and name
+
+	pendingMutex sync.Mutex // Serializes changes to the DWRITE journals in LocalPath
+	metaMutex    sync.Mutex // Serializes changes to the versions in the .meta files in LocalPath
+	logMutex     sync.Mutex // Serializes changes to the write log in LocalPath
+	logLimit     int64      // Size past which the write log is cut down, protected by logMutex
+}
+
+// Events a watch channel holds before further events are dropped
+const watchBuffer = 64
+
+const (
+	// How often a mount checks that its server answers
+	serverCheckInterval = time.Second
+
+	// How long a server has to answer a check, or a mount after failing over to it
+	serverTimeout = 3 * time.Second
+
+	// Failed checks in a row after which a mount fails over to another server
+	serverFailures = 2
+
+	// Longest wait between attempts of a disconnected mount to mount again,
+	// the wait starts at serverCheckInterval and doubles after each failure
+	maxReconnectInterval = 30 * time.Second
+)
+
+// Returns the client of the server the mount is on
+func (dfs *DFSInstance) client() *rpc.Client {
+	dfs.serverMutex.RLock()
+	defer dfs.serverMutex.RUnlock()
+	return dfs.Client
+}
+
+// Returns true if the mount is mounted on a server
+func (dfs *DFSInstance) connected() bool {
+	dfs.serverMutex.RLock()
+	defer dfs.serverMutex.RUnlock()
+	return dfs.Connected
+}
+
+// Returns the name the server knows the mount by, which rpc calls send as LocalPath
+func (dfs *DFSInstance) clientName() string {
+	dfs.serverMutex.RLock()
+	defer dfs.serverMutex.RUnlock()
+	return dfs.name
+}
+
+// Returns the address of the server the mount is on
+func (dfs *DFSInstance) server() string {
+	dfs.serverMutex.RLock()
+	defer dfs.serverMutex.RUnlock()
+	return dfs.ServerAddr
+}
+
+// Sets the servers to fail over to, the ones given to MountDFS are kept after the announced ones
+// Must hold serverMutex
+func (dfs *DFSInstance) setServers(announced []string) {
+	dfs.Servers = nil
+	for _, addr := range append(append([]string(nil), announced...), dfs.seeds...) {
+		if !contains(dfs.Servers, addr) {
+			dfs.Servers = append(dfs.Servers, addr)
+		}
+	}
+}
+
+// Checks the server every serverCheckInterval and fails over when it stops answering
+// When no server answers the mount is disconnected until mounting again succeeds,
+// which is retried with a backoff up to maxReconnectInterval
+func (dfs *DFSInstance) watchServer() {
+	failures := 0
+	backoff := serverCheckInterval
+	for {
+		wait := serverCheckInterval
+		if !dfs.connected() {
+			wait = backoff
+		}
+		select {
+		case <-dfs.done:
+			return
+		case <-time.After(wait):
+		}
+
+		if !dfs.connected() {
+			if dfs.failover() {
+				backoff = serverCheckInterval
+			} else if backoff *= 2; backoff > maxReconnectInterval {
+				backoff = maxReconnectInterval
 			}
+			continue
 		}
 
-		// Update local version if global and client files exists
-		if globalExists {
-			var reply shared.Reply
-			err = dfs.Client.Call("DFSServerInstance.ClientFilesOnline", args, &reply)
-			filesOnline := reply.Exists
-			if !filesOnline {
-				// Remove write access
-				var reply shared.Reply
-				args := &shared.Args{
-					Filename:  fname,
-					LocalPath: dfs.LocalPath,
-				}
-				err = dfs.Client.Call("DFSServerInstance.RemoveAccess", args, &reply)
-				return nil, FileUnavailableError(fname)
+		ctx, cancel := context.WithTimeout(context.Background(), serverTimeout)
+		var reply shared.Reply
+		args := &shared.Args{LocalPath: dfs.clientName()}
+		err := call(ctx, dfs.client(), "DFSServerInstance.IsConnected", args, &reply)
+		cancel()
+		if err == nil && !reply.Connected {
+			// The server dropped the mount after a gap in its heartbeats, mount again right away
+			err = dfs.remount(dfs.server())
+		}
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		if failures >= serverFailures {
+			failures = 0
+			if !dfs.failover() {
+				dfs.serverMutex.Lock()
+				dfs.Connected = false
+				dfs.serverMutex.Unlock()
 			}
+		}
+	}
+}
 
-			// Since there are clients online, open file to get latest versions
-			fileToChange, err = os.OpenFile(fullFilename, os.O_APPEND|os.O_RDWR, 0644)
+// Mounts on the first server that answers, in the order the primary announced them
+// The current server is tried last in case it only restarted
+func (dfs *DFSInstance) failover() bool {
+	dfs.serverMutex.RLock()
+	current := dfs.ServerAddr
+	var servers []string
+	for _, addr := range dfs.Servers {
+		if addr != current {
+			servers = append(servers, addr)
+		}
+	}
+	dfs.serverMutex.RUnlock()
 
-			// Get our version of file to compare with latest
-			reply = shared.Reply{}
-			args = &shared.Args{
-				Filename:  fname,
-				LocalPath: dfs.LocalPath,
-			}
-			_ = dfs.Client.Call("DFSServerInstance.Open", args, &reply)
-			versions = reply.Versions
+	for _, addr := range append(servers, current) {
+		if dfs.remount(addr) == nil {
+			return true
+		}
+	}
+	return false
+}
 
-			// Get the latest file from server
-			// Update server that we have latest file
-			reply = shared.Reply{}
-			for index := 0; index < 256; index++ {
-				// If not latest version, get chunk from server
-				if reply.Version > versions[index] {
-					var reply shared.Reply
-					args := &shared.Args{
-						Filename:    fname,
-						LocalPath:   dfs.LocalPath,
-						BytesToRead: 32,
-						Offset:      index * 32,
-						Chunknum:    uint8(index),
-						Mode:        int(mode),
-						Open:        true,
-					}
-					err = dfs.Client.Call("DFSServerInstance.Read", args, &reply)
-					if err != nil {
-						// Remove write access
-						var reply shared.Reply
-						args := &shared.Args{
-							Filename: fname,
-						}
-						err = dfs.Client.Call("DFSServerInstance.RemoveAccess", args, &reply)
-						return nil, ChunkUnavailableError(index)
-					}
+// Mounts on the server at addr in place of the current one, connecting the mount if it wasn't
+// The new server releases write access held through the old one, so files open
+// for writing can't be written again
+func (dfs *DFSInstance) remount(addr string) error {
+	localIP, _, _ := net.SplitHostPort(dfs.IPAddr)
+	local, _ := net.ResolveTCPAddr("tcp", net.JoinHostPort(localIP, "0"))
+	dialer := &net.Dialer{LocalAddr: local, Timeout: serverTimeout}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	client := rpc.NewClient(conn)
 
-					// Save chunk to file
-					_, err = fileToChange.WriteAt(reply.Chunk[:], int64(args.Offset))
-					if err != nil {
-					}
-					// Save read part to disk
-					fileToChange.Sync()
-				}
+	ctx, cancel := context.WithTimeout(context.Background(), serverTimeout)
+	defer cancel()
+	var reply shared.Reply
+	args := &shared.Args{
+		LocalPath:  dfs.LocalPath,
+		Addr:       dfs.Listener.Addr().String(),
+		ServerAddr: addr,
+		UUID:       dfs.UUID,
+		Files:      dfs.inventory(),
+	}
+	err = call(ctx, client, "DFSServerInstance.Mount", args, &reply)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	for _, change := range reply.Changes {
+		applyNamespaceChange(dfs.LocalPath, change)
+		dfs.moveWatchers(change)
+	}
+
+	dfs.serverMutex.Lock()
+	select {
+	case <-dfs.done:
+		// Unmounted while failing over
+		dfs.serverMutex.Unlock()
+		client.Close()
+		return nil
+	default:
+	}
+	old := dfs.Client
+	dfs.Client = client
+	dfs.ServerAddr = addr
+	dfs.Connected = true
+	dfs.name = reply.LocalPath
+	dfs.setServers(reply.Servers)
+	dfs.serverMutex.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	// Watches were registered with the old server
+	dfs.mutex.Lock()
+	var watched []string
+	for fname := range dfs.watchers {
+		watched = append(watched, fname)
+	}
+	dfs.mutex.Unlock()
+	for _, fname := range watched {
+		args := &shared.Args{
+			Filename:  fname,
+			LocalPath: dfs.clientName(),
+		}
+		client.Call("DFSServerInstance.Watch", args, new(shared.Reply))
+	}
+
+	// The old server may have gone down before writes made offline were published
+	dfs.recoverWrites()
+	dfs.publishWrites(false)
+	return nil
+}
+
+// Returns the files with a copy in the local path and the versions of their chunks,
+// reported to the server when mounting so it knows what we hold
+func (dfs *DFSInstance) inventory() []*shared.FileMetadata {
+	names, err := dfs.ListLocalFiles()
+	if err != nil {
+		return nil
+	}
+	var files []*shared.FileMetadata
+	for _, fname := range names {
+		meta, err := readMetadata(dfs.LocalPath, fname)
+		if err != nil {
+			// Chunks of a copy without metadata count as older than any written
+			meta = &shared.FileMetadata{}
+		}
+		meta.Name = fname
+		files = append(files, meta)
+	}
+	return files
+}
+
+// Records in the metadata of fname the versions of chunks its local copy now holds
+func (dfs *DFSInstance) saveVersions(fname string, chunkSize int, versions map[uint32]int) error {
+	dfs.metaMutex.Lock()
+	defer dfs.metaMutex.Unlock()
+	meta, err := readMetadata(dfs.LocalPath, fname)
+	if err != nil {
+		meta = &shared.FileMetadata{
+			Name:      fname,
+			ChunkSize: chunkSize,
+		}
+	}
+	if meta.Versions == nil {
+		meta.Versions = make(map[uint32]int)
+	}
+	for chunkNum, version := range versions {
+		meta.Versions[chunkNum] = version
+	}
+	return writeMetadata(dfs.LocalPath, meta)
+}
+
+// Serves rpc calls from the server until the mount is unmounted
+func (dfs *DFSInstance) serveServer() {
+	for {
+		// Accept connections and block until listener receives non-nil error
+		accept, err := dfs.Listener.Accept()
+		if err != nil {
+			select {
+			case <-dfs.done:
+				return
+			default:
+				continue
 			}
+		}
+		dfs.mutex.Lock()
+		dfs.conns = append(dfs.conns, accept)
+		dfs.mutex.Unlock()
+		go dfs.Server.ServeConn(accept)
+	}
+}
 
-			// update versioning of local file
-			reply = shared.Reply{}
-			args = &shared.Args{
-				Filename:  fname,
-				LocalPath: dfs.LocalPath,
+// Sends a heartbeat to the server every 2 seconds until the mount is unmounted
+func (dfs *DFSInstance) SendUDPHeartbeat(fname string) (exists bool, err error) {
+	myaddr, _ := net.ResolveUDPAddr("udp", dfs.IPAddr)
+
+	var conn *net.UDPConn
+	dialed := ""
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		// Follow the mount to a new server after failing over
+		if server := dfs.server(); server != dialed {
+			if conn != nil {
+				conn.Close()
 			}
-			_ = dfs.Client.Call("DFSServerInstance.Open", args, &reply)
-			versions = reply.Versions
+			addr, _ := net.ResolveUDPAddr("udp", server)
+			conn, err = net.DialUDP("udp", myaddr, addr)
+			if err != nil {
+				return false, err
+			}
+			dialed = server
+			dfs.Heartbeat = conn
+		}
 
-			// Close the file to prevent opening twice
-			fileToChange.Close()
+		currentTime := time.Now()
+		beat := &shared.Heartbeat{
+			LocalPath: dfs.clientName(),
+			TimeSent:  currentTime,
+		}
+		msg, err := json.Marshal(beat)
+		if err != nil {
+			//fmt.Println("Error marshaling data")
+		}
+
+		//	msg := []byte("Hello there")
+
+		_, err = conn.Write(msg)
+		if err != nil {
+			//fmt.Println("Error writing to UDP Conn")
+		}
+
+		select {
+		case <-dfs.done:
+			return false, nil
+		case <-time.After(2*time.Second - time.Since(currentTime)):
 		}
 	}
+}
 
-	// Return instance of file
-	file, err = os.OpenFile(fullFilename, os.O_APPEND|os.O_RDWR, 0644)
+// Return true if file is on disk, else return false
+func (dfs *DFSInstance) LocalFileExists(fname string) (exists bool, err error) {
+	return dfs.LocalFileExistsContext(context.Background(), fname)
+}
+
+// LocalFileExists that gives up when ctx is done
+func (dfs *DFSInstance) LocalFileExistsContext(ctx context.Context, fname string) (exists bool, err error) {
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+
+	// Check arguments
+	if !isValidPath(fname) {
+		return false, BadFilenameError(fname)
+	}
+
+	// Check if file exists, needs .dfs ext
+	ext := fmt.Sprintf("%s.dfs", fname)
+	file := filepath.Join(dfs.LocalPath, ext)
+
+	_, err = os.Stat(file)
 	if err != nil {
-		// Remove write access
-		var reply shared.Reply
-		args := &shared.Args{
-			Filename: fname,
+		return false, nil
+	}
+	return true, nil
+}
+
+// Return true if file exists, else return false
+func (dfs *DFSInstance) GlobalFileExists(fname string) (exists bool, err error) {
+	return dfs.GlobalFileExistsContext(context.Background(), fname)
+}
+
+// GlobalFileExists that gives up when ctx is done
+func (dfs *DFSInstance) GlobalFileExistsContext(ctx context.Context, fname string) (exists bool, err error) {
+	// Check arguments
+	if !isValidPath(fname) {
+		return false, BadFilenameError(fname)
+	}
+	if !dfs.connected() {
+		return false, DisconnectedError(dfs.server())
+	}
+
+	var reply shared.Reply
+	args := &shared.Args{
+		Filename: fname,
+	}
+
+	err = call(ctx, dfs.client(), "DFSServerInstance.GlobalFileExists", args, &reply)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if err != nil {
+		return false, DisconnectedError(dfs.server())
+	}
+	return reply.Exists, nil
+}
+
+// Client call to open a file for reading and writing
+// Opens the file if already there otherwise creates one
+func (dfs *DFSInstance) Open(fname string, mode FileMode) (f DFSFile, err error) {
+	return dfs.openContext(context.Background(), fname, mode, DefaultChunkSize, false)
+}
+
+// Open that creates missing files with chunkSize bytes per chunk
+func (dfs *DFSInstance) OpenWithChunkSize(fname string, mode FileMode, chunkSize int) (f DFSFile, err error) {
+	return dfs.openContext(context.Background(), fname, mode, chunkSize, false)
+}
+
+// Open that gives up when ctx is done
+func (dfs *DFSInstance) OpenContext(ctx context.Context, fname string, mode FileMode) (f DFSFile, err error) {
+	return dfs.openContext(ctx, fname, mode, DefaultChunkSize, false)
+}
+
+// Open that queues for write access until ctx is done
+func (dfs *DFSInstance) OpenWait(ctx context.Context, fname string, mode FileMode) (f DFSFile, err error) {
+	return dfs.openContext(ctx, fname, mode, DefaultChunkSize, true)
+}
+
+// Opens fname, creating it with chunkSize bytes per chunk if missing
+// If wait is true, WRITE mode waits in the server's queue for write access
+// If ctx is done before the file is open, write access the server granted is given back
+func (dfs *DFSInstance) openContext(ctx context.Context, fname string, mode FileMode, chunkSize int, wait bool) (f DFSFile, err error) {
+
+	// Check validity of fname
+	if !isValidPath(fname) {
+		return nil, BadFilenameError(fname)
+	}
+	if chunkSize < MinChunkSize || chunkSize > MaxChunkSize {
+		return nil, BadChunkSizeError(chunkSize)
+	}
+
+	var file *os.File
+	var fileToChange *os.File
+	var epoch int
+	var lease time.Duration
+	versions := make(map[uint32]int)
+
+	// Get full path of file
+	ext := fmt.Sprintf("%s.dfs", fname)
+	fullFilename := filepath.Join(dfs.LocalPath, ext)
+
+	// Check if file exists locally, existing files keep their chunk size
+	exists, err := dfs.LocalFileExistsContext(ctx, fname)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if exists {
+		chunkSize = DefaultChunkSize
+		meta, err := readMetadata(dfs.LocalPath, fname)
+		if err == nil && meta.ChunkSize > 0 {
+			chunkSize = meta.ChunkSize
 		}
-		err = dfs.Client.Call("DFSServerInstance.RemoveAccess", args, &reply)
-		return nil, FileDoesNotExistError(fname)
 	}
 
-	openFile := &OpenFile{
-		Name:      fname,
-		File:      file,
-		Mode:      mode,
-		Connected: dfs.Connected,
-		Server:    dfs.ServerAddr,
-		Versions:  versions,
-		Client:    dfs.Client,
-		LocalPath: dfs.LocalPath,
+	// If DREAD or DWRITE, return FileDoesNotExistError if file doesnt exist
+	if mode == DREAD || mode == DWRITE {
+		if !exists {
+			return nil, FileDoesNotExistError(fname)
+		}
+		// DWRITE writes are made against the versions of the local copy
+		if mode == DWRITE {
+			versions = dfs.localVersions(fname)
+		}
+	} else if mode == READ || mode == WRITE || mode == CWRITE {
+		//If disconnected return DisconnectedError
+		if !dfs.connected() {
+			return nil, DisconnectedError(dfs.server())
+		}
+
+		// If mode == WRITE and somebody is already writing to file, return OpenWriteConflict
+		// Otherwise tell server we're writing
+		if mode == WRITE {
+			var reply shared.Reply
+			args := &shared.Args{
+				LocalPath: dfs.clientName(),
+				Filename:  fname,
+				Mode:      int(mode),
+			}
+			method := "DFSServerInstance.Writeable"
+			if wait {
+				method = "DFSServerInstance.WaitWriteable"
+				args.Ticket = dfs.ticket()
+			}
+			c := dfs.client().Go(method, args, &reply, make(chan *rpc.Call, 1))
+			select {
+			case <-c.Done:
+			case <-ctx.Done():
+				// Give access back if the server grants it after we gave up
+				go func() {
+					if wait {
+						// Leave the queue
+						var cancelReply shared.Reply
+						dfs.client().Call("DFSServerInstance.CancelWait", args, &cancelReply)
+					}
+					<-c.Done
+					if reply.Writeable {
+						dfs.releaseAccess(fname, reply.Epoch)
+					}
+				}()
+				return nil, ctx.Err()
+			}
+			if c.Error != nil {
+				return nil, DisconnectedError(dfs.server())
+			}
+			if !reply.Writeable {
+				return nil, OpenWriteConflictError(fname)
+			}
+			epoch = reply.Epoch
+			lease = reply.Lease
+
+			// Give access back if we give up later on
+			defer func() {
+				if ctx.Err() != nil && f == nil {
+					go dfs.releaseAccess(fname, epoch)
+				}
+			}()
+		}
+
+		// Check if log file exists. If not, create and tell server
+		logFilePath := filepath.Join(dfs.LocalPath, "log.dfs")
+		_, err = os.Stat(logFilePath)
+		logFileExists := err == nil
+
+		if !logFileExists {
+			// Create the file
+			logFileName := filepath.Join(dfs.LocalPath, "log.dfs")
+			log, err := os.Create(logFileName)
+			log.Sync()
+
+			var reply shared.Reply
+			args := &shared.Args{
+				Filename:  "log",
+				LocalPath: dfs.clientName(),
+				Versions:  versions,
+				ChunkSize: DefaultChunkSize,
+			}
+			// Update server that file exists
+			err = call(ctx, dfs.client(), "DFSServerInstance.UpdateServer", args, &reply)
+			if err != nil {
+				//fmt.Println("Could not update server") //delete
+			}
+		}
+
+		// Gives write access back and returns the error for a failed server call
+		// If ctx is done access is given back by the deferred call above
+		callFailed := func(err error) (DFSFile, error) {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if mode == WRITE {
+				dfs.releaseAccess(fname, epoch)
+			}
+			if _, refused := err.(rpc.ServerError); refused {
+				// Server refused the name
+				return nil, BadFilenameError(fname)
+			}
+			return nil, DisconnectedError(dfs.server())
+		}
+
+		// Check if global file exists and if client with file connected.
+		//If not, return FileUnavailableError
+		var reply shared.Reply
+		args := &shared.Args{
+			Filename:  fname,
+			LocalPath: dfs.clientName(),
+		}
+		err = call(ctx, dfs.client(), "DFSServerInstance.GlobalFileExists", args, &reply)
+		if err != nil {
+			return callFailed(err)
+		}
+		globalExists := reply.Exists
+
+		// New files can't take the name of a directory
+		if !globalExists {
+			var reply shared.Reply
+			args := &shared.Args{
+				Filename: fname,
+			}
+			err = call(ctx, dfs.client(), "DFSServerInstance.DirectoryExists", args, &reply)
+			if err != nil {
+				return callFailed(err)
+			}
+			if reply.Exists {
+				// Remove write access
+				if mode == WRITE {
+					dfs.releaseAccess(fname, epoch)
+				}
+				return nil, BadFilenameError(fname)
+			}
+		}
+
+		// New files need their directory to exist
+		if !globalExists && parentDir(fname) != "" {
+			var reply shared.Reply
+			args := &shared.Args{
+				Filename: parentDir(fname),
+			}
+			err = call(ctx, dfs.client(), "DFSServerInstance.DirectoryExists", args, &reply)
+			if err != nil {
+				return callFailed(err)
+			}
+			if !reply.Exists {
+				// Remove write access
+				if mode == WRITE {
+					dfs.releaseAccess(fname, epoch)
+				}
+				return nil, DirectoryDoesNotExistError(parentDir(fname))
+			}
+		}
+
+		// Files already in the DFS use the chunk size they were created with
+		// A local copy with another chunk size is recreated and holds none of the file's chunks
+		recreated := false
+		if globalExists && reply.ChunkSize > 0 && reply.ChunkSize != chunkSize {
+			chunkSize = reply.ChunkSize
+			exists = false
+			recreated = true
+		}
+
+		// If local file doesn't exist, create it
+		if !exists {
+			// Create the file, mirroring its directory locally
+			os.MkdirAll(filepath.Dir(fullFilename), 0755)
+			fileToChange, err = os.Create(fullFilename)
+			//fileToChange.Truncate(int64(256 * 32))
+			fileToChange.Sync()
+			fileToChange.Close()
+
+			err = writeMetadata(dfs.LocalPath, &shared.FileMetadata{
+				Name:      fname,
+				ChunkSize: chunkSize,
+			})
+			if err != nil {
+				//fmt.Println("Could not save file metadata") //delete
+			}
+		}
+
+		// Update server that file exists if it doesn't know we have it yet
+		// or still lists the versions of a copy we recreated
+		reply = shared.Reply{}
+		err = call(ctx, dfs.client(), "DFSServerInstance.Open", args, &reply)
+		if err != nil {
+			return callFailed(err)
+		}
+		if !reply.Exists || recreated {
+			var reply shared.Reply
+			args := &shared.Args{
+				Filename:  fname,
+				LocalPath: dfs.clientName(),
+				Versions:  versions,
+				ChunkSize: chunkSize,
+			}
+			err = call(ctx, dfs.client(), "DFSServerInstance.UpdateServer", args, &reply)
+			if err != nil {
+				return callFailed(err)
+			}
+		}
+
+		// Update local version if global and client files exists
+		if globalExists {
+			var reply shared.Reply
+			err = call(ctx, dfs.client(), "DFSServerInstance.ClientFilesOnline", args, &reply)
+			if err != nil {
+				return callFailed(err)
+			}
+			filesOnline := reply.Exists
+			if !filesOnline {
+				// Remove write access
+				if mode == WRITE {
+					dfs.releaseAccess(fname, epoch)
+				}
+				return nil, FileUnavailableError(fname)
+			}
+
+			// Since there are clients online, open file to get latest versions
+			fileToChange, err = os.OpenFile(fullFilename, os.O_RDWR, 0644)
+
+			// Get our version of file to compare with latest
+			reply = shared.Reply{}
+			args = &shared.Args{
+				Filename:  fname,
+				LocalPath: dfs.clientName(),
+			}
+			err = call(ctx, dfs.client(), "DFSServerInstance.Open", args, &reply)
+			if err != nil {
+				fileToChange.Close()
+				return callFailed(err)
+			}
+			versions = shared.CopyVersions(reply.Versions)
+
+			// Get the latest file from server
+			// Update server that we have latest file
+			reply = shared.Reply{}
+			err = call(ctx, dfs.client(), "DFSServerInstance.LatestVersions", args, &reply)
+			if err != nil {
+				fileToChange.Close()
+				return callFailed(err)
+			}
+			latest := reply.Versions
+			for index, version := range latest {
+				// If not latest version, get chunk from server
+				if version > versions[index] {
+					var reply shared.Reply
+					args := &shared.Args{
+						Filename:    fname,
+						LocalPath:   dfs.clientName(),
+						BytesToRead: chunkSize,
+						Offset:      int(index) * chunkSize,
+						Chunknum:    index,
+						Mode:        int(mode),
+						Open:        true,
+					}
+					err = call(ctx, dfs.client(), "DFSServerInstance.Read", args, &reply)
+					if ctx.Err() != nil {
+						fileToChange.Close()
+						return nil, ctx.Err()
+					}
+					if err != nil {
+						// Remove write access
+						fileToChange.Close()
+						if mode == WRITE {
+							dfs.releaseAccess(fname, epoch)
+						}
+						return nil, ChunkUnavailableError(index)
+					}
+
+					// Save chunk to file
+					err = writeChunkAt(fileToChange, reply.Data, chunkSize, int64(args.Offset))
+					if err != nil {
+					}
+					// Save read part to disk
+					fileToChange.Sync()
+				}
+			}
+
+			// update versioning of local file
+			reply = shared.Reply{}
+			args = &shared.Args{
+				Filename:  fname,
+				LocalPath: dfs.clientName(),
+			}
+			err = call(ctx, dfs.client(), "DFSServerInstance.Open", args, &reply)
+			if err != nil {
+				fileToChange.Close()
+				return callFailed(err)
+			}
+			versions = shared.CopyVersions(reply.Versions)
+			dfs.saveVersions(fname, chunkSize, versions)
+
+			// Close the file to prevent opening twice
+			fileToChange.Close()
+		}
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+
+	// Return instance of file
+	file, err = os.OpenFile(fullFilename, os.O_RDWR, 0644)
+	if err != nil {
+		// Remove write access
+		if mode == WRITE {
+			dfs.releaseAccess(fname, epoch)
+		}
+		return nil, FileDoesNotExistError(fname)
+	}
+
+	openFile := &OpenFile{
+		Name:          fname,
+		File:          file,
+		Mode:          mode,
+		Connected:     dfs.connected(),
+		Server:        dfs.server(),
+		Versions:      versions,
+		BytesPerChunk: chunkSize,
+		LocalPath:     dfs.LocalPath,
+		Epoch:         epoch,
+		mount:         dfs,
+	}
+
+	// Keep the write lease while the file is open
+	if mode == WRITE {
+		openFile.leases = map[int]time.Time{epoch: time.Now().Add(lease)}
+		openFile.stopRenew = make(chan struct{})
+		go openFile.renewLease(lease, openFile.stopRenew)
+	}
+
+	dfs.mutex.Lock()
+	dfs.FilesOpened = append(dfs.FilesOpened, openFile)
+	dfs.mutex.Unlock()
+
+	return openFile, nil
+}
+
+// Create directory on server and in local path
+func (dfs *DFSInstance) Mkdir(dir string) (err error) {
+	if !isValidPath(dir) {
+		return BadFilenameError(dir)
+	}
+	if !dfs.connected() {
+		return DisconnectedError(dfs.server())
+	}
+
+	var reply shared.Reply
+	args := &shared.Args{
+		Filename: dir,
+	}
+	err = dfs.client().Call("DFSServerInstance.Mkdir", args, &reply)
+	if _, ok := err.(rpc.ServerError); ok {
+		// Server refused because dir names a file
+		return BadFilenameError(dir)
+	} else if err != nil {
+		return DisconnectedError(dfs.server())
+	}
+	if !reply.Exists {
+		return DirectoryDoesNotExistError(parentDir(dir))
+	}
+
+	err = os.MkdirAll(filepath.Join(dfs.LocalPath, dir), 0755)
+	if err != nil {
+		return LocalPathError(dfs.LocalPath)
+	}
+	return nil
+}
+
+// Return files and directories in dir
+func (dfs *DFSInstance) ReadDir(dir string) (entries []DirEntry, err error) {
+	if dir != "" && !isValidPath(dir) {
+		return nil, BadFilenameError(dir)
+	}
+	if !dfs.connected() {
+		return nil, DisconnectedError(dfs.server())
+	}
+
+	var reply shared.Reply
+	args := &shared.Args{
+		Filename: dir,
+	}
+	err = dfs.client().Call("DFSServerInstance.ReadDir", args, &reply)
+	if err != nil {
+		return nil, DisconnectedError(dfs.server())
+	}
+	if !reply.Exists {
+		return nil, DirectoryDoesNotExistError(dir)
+	}
+
+	for _, entry := range reply.Entries {
+		entries = append(entries, DirEntry{Name: entry.Name, IsDir: entry.IsDir})
+	}
+	return entries, nil
+}
+
+// Remove empty directory from server and local path
+func (dfs *DFSInstance) Rmdir(dir string) (err error) {
+	if !isValidPath(dir) {
+		return BadFilenameError(dir)
+	}
+	if !dfs.connected() {
+		return DisconnectedError(dfs.server())
+	}
+
+	var reply shared.Reply
+	args := &shared.Args{
+		Filename: dir,
+	}
+	err = dfs.client().Call("DFSServerInstance.Rmdir", args, &reply)
+	if err != nil {
+		return DisconnectedError(dfs.server())
+	}
+	if !reply.Exists {
+		return DirectoryDoesNotExistError(dir)
+	}
+	if len(reply.Entries) > 0 {
+		return DirectoryNotEmptyError(dir)
+	}
+
+	// DFS files left locally are stale now that the directory is gone
+	removeLocalDir(filepath.Join(dfs.LocalPath, dir))
+	return nil
+}
+
+// Removes the DFS files under a local directory, with the DWRITE writes to them, then the directories left empty
+// Files the DFS didn't make are kept along with the directories holding them
+func removeLocalDir(dir string) {
+	var dirs []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+		} else if strings.HasSuffix(path, ".dfs") || strings.HasSuffix(path, ".meta") || strings.HasSuffix(path, ".pending") {
+			os.Remove(path)
+		}
+		return nil
+	})
+	// Walk lists a directory before its contents, remove the deepest first
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(dirs[i])
+	}
+}
+
+// Remove file from server and every client
+func (dfs *DFSInstance) Remove(fname string) (err error) {
+	if !isValidPath(fname) {
+		return BadFilenameError(fname)
+	}
+	if !dfs.connected() {
+		return DisconnectedError(dfs.server())
+	}
+
+	var reply shared.Reply
+	args := &shared.Args{
+		Filename:  fname,
+		LocalPath: dfs.clientName(),
+	}
+	err = dfs.client().Call("DFSServerInstance.Remove", args, &reply)
+	if err != nil {
+		return DisconnectedError(dfs.server())
+	}
+	if !reply.Exists {
+		return FileNotFoundError(fname)
+	}
+	if !reply.Writeable {
+		return OpenWriteConflictError(fname)
+	}
+
+	change := shared.NamespaceChange{Filename: fname}
+	applyNamespaceChange(dfs.LocalPath, change)
+	dfs.moveWatchers(change)
+	return nil
+}
+
+// Return file metadata from server, or local copy if disconnected
+func (dfs *DFSInstance) Stat(fname string) (info *FileInfo, err error) {
+	if !isValidPath(fname) {
+		return nil, BadFilenameError(fname)
+	}
+
+	info = &FileInfo{
+		Name:      fname,
+		ChunkSize: DefaultChunkSize,
+	}
+
+	// Local copy
+	localSize := int64(0)
+	ext := fmt.Sprintf("%s.dfs", fname)
+	stat, err := os.Stat(filepath.Join(dfs.LocalPath, ext))
+	if err == nil {
+		info.Local = true
+		localSize = stat.Size()
+		meta, err := readMetadata(dfs.LocalPath, fname)
+		if err == nil && meta.ChunkSize > 0 {
+			info.ChunkSize = meta.ChunkSize
+		}
+	}
+
+	if !dfs.connected() {
+		if !info.Local {
+			return nil, FileNotFoundError(fname)
+		}
+		info.Size = localSize
+		return info, nil
+	}
+
+	var reply shared.Reply
+	args := &shared.Args{
+		Filename:  fname,
+		LocalPath: dfs.clientName(),
+	}
+	err = dfs.client().Call("DFSServerInstance.Stat", args, &reply)
+	if err != nil {
+		return nil, DisconnectedError(dfs.server())
+	}
+	if !reply.Exists {
+		return nil, FileNotFoundError(fname)
+	}
+
+	info.Connected = true
+	info.Versions = reply.Versions
+	info.Holders = reply.Holders
+	info.Writer = reply.Writer
+	if reply.ChunkSize > 0 {
+		info.ChunkSize = reply.ChunkSize
+	}
+
+	// Size covers every chunk written, exact if we have all of them
+	for chunkNum, version := range info.Versions {
+		if end := (int64(chunkNum) + 1) * int64(info.ChunkSize); version > 0 && end > info.Size {
+			info.Size = end
+		}
+	}
+	if info.Local {
+		info.LocalVersions, info.Fresh = reply.Holders[dfs.clientName()]
+		for chunkNum, version := range info.Versions {
+			if info.LocalVersions[chunkNum] < version {
+				info.Fresh = false
+			}
+		}
+		if info.Fresh {
+			info.Size = localSize
+		}
+	}
+	return info, nil
+}
+
+// Return a page of files in the server
+func (dfs *DFSInstance) ListGlobalFiles(prefix string, after string, limit int) (names []string, err error) {
+	if !dfs.connected() {
+		return nil, DisconnectedError(dfs.server())
+	}
+
+	var reply shared.Reply
+	args := &shared.Args{
+		Prefix: prefix,
+		After:  after,
+		Limit:  limit,
+	}
+	err = dfs.client().Call("DFSServerInstance.ListFiles", args, &reply)
+	if err != nil {
+		return nil, DisconnectedError(dfs.server())
+	}
+	return reply.Names, nil
+}
+
+// Return files with a .dfs copy under the local path, except the log
+func (dfs *DFSInstance) ListLocalFiles() (names []string, err error) {
+	err = filepath.Walk(dfs.LocalPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".dfs" {
+			return nil
+		}
+		rel, err := filepath.Rel(dfs.LocalPath, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(strings.TrimSuffix(rel, ".dfs"))
+		if isValidPath(name) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, LocalPathError(dfs.LocalPath)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Rename file on server and every client
+func (dfs *DFSInstance) Rename(oldName string, newName string) (err error) {
+	if !isValidPath(oldName) {
+		return BadFilenameError(oldName)
+	}
+	if !isValidPath(newName) {
+		return BadFilenameError(newName)
+	}
+	if !dfs.connected() {
+		return DisconnectedError(dfs.server())
+	}
+
+	var reply shared.Reply
+	args := &shared.Args{
+		Filename:  oldName,
+		NewName:   newName,
+		LocalPath: dfs.clientName(),
+	}
+	err = dfs.client().Call("DFSServerInstance.Rename", args, &reply)
+	if err != nil {
+		return DisconnectedError(dfs.server())
+	}
+	if !reply.Exists {
+		return FileNotFoundError(oldName)
+	}
+	if !reply.Writeable {
+		return OpenWriteConflictError(oldName)
+	}
+	if reply.Filename == newName {
+		return FileExistsError(newName)
+	}
+	if reply.Filename != "" {
+		return DirectoryDoesNotExistError(reply.Filename)
+	}
+
+	change := shared.NamespaceChange{Filename: oldName, NewName: newName}
+	applyNamespaceChange(dfs.LocalPath, change)
+	dfs.moveWatchers(change)
+	return nil
+}
+
+// Register with the server for writes to fname and return a channel of them
+func (dfs *DFSInstance) Watch(fname string) (events <-chan ChangeEvent, err error) {
+	if !isValidPath(fname) {
+		return nil, BadFilenameError(fname)
+	}
+	if !dfs.connected() {
+		return nil, DisconnectedError(dfs.server())
+	}
+
+	var reply shared.Reply
+	args := &shared.Args{
+		Filename:  fname,
+		LocalPath: dfs.clientName(),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), serverTimeout)
+	defer cancel()
+	err = call(ctx, dfs.client(), "DFSServerInstance.Watch", args, &reply)
+	if err != nil {
+		return nil, DisconnectedError(dfs.server())
+	}
+
+	ch := make(chan ChangeEvent, watchBuffer)
+	dfs.mutex.Lock()
+	unmounted := dfs.watchers == nil
+	if !unmounted {
+		dfs.watchers[fname] = append(dfs.watchers[fname], ch)
+	}
+	dfs.mutex.Unlock()
+	if unmounted {
+		// UMountDFS closed the watchers
+		return nil, DisconnectedError(dfs.server())
+	}
+	return ch, nil
+}
+
+// Moves the channels watching a renamed file to its new name, closes those watching a removed one
+func (dfs *DFSInstance) moveWatchers(change shared.NamespaceChange) {
+	dfs.mutex.Lock()
+	defer dfs.mutex.Unlock()
+	channels, watched := dfs.watchers[change.Filename]
+	if !watched {
+		return
+	}
+	delete(dfs.watchers, change.Filename)
+	if change.NewName != "" {
+		dfs.watchers[change.NewName] = append(dfs.watchers[change.NewName], channels...)
+		return
+	}
+	for _, ch := range channels {
+		close(ch)
+	}
+}
+
+// Sends event to every channel watching its file without blocking
+func (dfs *DFSInstance) notify(event ChangeEvent) {
+	dfs.mutex.Lock()
+	defer dfs.mutex.Unlock()
+	for _, ch := range dfs.watchers[event.Name] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Returns a number identifying a wait for write access to the server
+func (dfs *DFSInstance) ticket() uint64 {
+	dfs.mutex.Lock()
+	defer dfs.mutex.Unlock()
+	dfs.tickets++
+	return dfs.tickets
+}
+
+// Tells the server we are no longer writing to fname under the lease of epoch
+func (dfs *DFSInstance) releaseAccess(fname string, epoch int) {
+	var reply shared.Reply
+	args := &shared.Args{
+		Filename:  fname,
+		LocalPath: dfs.clientName(),
+		Epoch:     epoch,
+	}
+	dfs.client().Call("DFSServerInstance.RemoveAccess", args, &reply)
+}
+
+// Returns chunks with fewer live copies than the replication factor
+func (dfs *DFSInstance) UnderReplicated() (chunks []ChunkReplicas, err error) {
+	if !dfs.connected() {
+		return nil, DisconnectedError(dfs.server())
+	}
+
+	var reply shared.Reply
+	err = dfs.client().Call("DFSServerInstance.UnderReplicated", &shared.Args{}, &reply)
+	if err != nil {
+		return nil, DisconnectedError(dfs.server())
+	}
+	for _, chunk := range reply.Replicas {
+		chunks = append(chunks, ChunkReplicas{
+			Name:     chunk.Filename,
+			Chunk:    chunk.Chunknum,
+			Version:  chunk.Version,
+			Replicas: chunk.Replicas,
+			Live:     chunk.Live,
+		})
+	}
+	return chunks, nil
+}
+
+// Returns the server's repair metrics
+func (dfs *DFSInstance) RepairStatus() (status *RepairStatus, err error) {
+	if !dfs.connected() {
+		return nil, DisconnectedError(dfs.server())
+	}
+
+	var reply shared.Reply
+	err = dfs.client().Call("DFSServerInstance.RepairStatus", &shared.Args{}, &reply)
+	if err != nil {
+		return nil, DisconnectedError(dfs.server())
+	}
+	return &RepairStatus{
+		Backlog:     reply.Repairs.Backlog,
+		Unavailable: reply.Repairs.Unavailable,
+		Queued:      reply.Repairs.Queued,
+		Repaired:    reply.Repairs.Repaired,
+		Failed:      reply.Repairs.Failed,
+		LastScan:    reply.Repairs.LastScan,
+	}, nil
+}
+
+// Publish writes made in DWRITE mode
+func (dfs *DFSInstance) Reconcile() (conflicts []WriteConflict, err error) {
+	return dfs.publishWrites(true)
+}
+
+// Publishes writes made in DWRITE mode, conflicts are dropped once the app is handed them
+func (dfs *DFSInstance) publishWrites(dropConflicts bool) (conflicts []WriteConflict, err error) {
+	if !dfs.connected() {
+		return nil, DisconnectedError(dfs.server())
+	}
+	names, err := dfs.pendingFiles()
+	if err != nil {
+		return nil, LocalPathError(dfs.LocalPath)
+	}
+	for _, fname := range names {
+		fileConflicts, fileErr := dfs.reconcile(fname, dropConflicts)
+		conflicts = append(conflicts, fileConflicts...)
+		if fileErr != nil && err == nil {
+			err = fileErr
+		}
+	}
+	return conflicts, err
+}
+
+// Returns the files with DWRITE writes in the local path, sorted by path
+func (dfs *DFSInstance) pendingFiles() (names []string, err error) {
+	err = filepath.Walk(dfs.LocalPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".pending" {
+			return nil
+		}
+		rel, err := filepath.Rel(dfs.LocalPath, path)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(strings.TrimSuffix(rel, ".pending")))
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// Publishes the DWRITE writes to fname while holding its write lease
+// Published chunks are copied into the local copy, which only ever holds versions the server knows
+func (dfs *DFSInstance) reconcile(fname string, dropConflicts bool) (conflicts []WriteConflict, err error) {
+	dfs.pendingMutex.Lock()
+	defer dfs.pendingMutex.Unlock()
+	pending, err := readPending(dfs.LocalPath, fname)
+	if err != nil {
+		return nil, LocalPathError(dfs.LocalPath)
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	// Taking the write lease would cut off our own open file
+	if dfs.writing(fname) {
+		return nil, OpenWriteConflictError(fname)
+	}
+
+	var reply shared.Reply
+	args := &shared.Args{
+		Filename:  fname,
+		LocalPath: dfs.clientName(),
+		Mode:      int(WRITE),
+	}
+	err = dfs.client().Call("DFSServerInstance.GlobalFileExists", args, &reply)
+	if err != nil {
+		return nil, DisconnectedError(dfs.server())
+	}
+	if !reply.Exists {
+		return nil, FileNotFoundError(fname)
+	}
+	chunkSize := reply.ChunkSize
+
+	// Hold the write lease so the chunks can't change while they are published
+	reply = shared.Reply{}
+	err = dfs.client().Call("DFSServerInstance.Writeable", args, &reply)
+	if err != nil {
+		return nil, DisconnectedError(dfs.server())
+	}
+	if !reply.Writeable {
+		return nil, OpenWriteConflictError(fname)
+	}
+	epoch := reply.Epoch
+	defer dfs.releaseAccess(fname, epoch)
+
+	// The server only takes writes to files it knows we have
+	versions := dfs.localVersions(fname)
+	reply = shared.Reply{}
+	_ = dfs.client().Call("DFSServerInstance.Open", args, &reply)
+	if !reply.Exists {
+		args := &shared.Args{
+			Filename:  fname,
+			LocalPath: dfs.clientName(),
+			Versions:  versions,
+			ChunkSize: chunkSize,
+		}
+		err = dfs.client().Call("DFSServerInstance.UpdateServer", args, new(shared.Reply))
+		if err != nil {
+			return nil, DisconnectedError(dfs.server())
+		}
+	}
+
+	file, err := os.OpenFile(filepath.Join(dfs.LocalPath, fmt.Sprintf("%s.dfs", fname)), os.O_RDWR, 0644)
+	if err != nil {
+		return nil, LocalPathError(dfs.LocalPath)
+	}
+	defer file.Close()
+	defer func() {
+		// Keep what is left for the next Reconcile
+		if saveErr := writePending(dfs.LocalPath, fname, pending); saveErr != nil && err == nil {
+			err = LocalPathError(dfs.LocalPath)
+		}
+		dfs.saveVersions(fname, chunkSize, versions)
+	}()
+
+	var chunks []uint32
+	for chunkNum := range pending {
+		chunks = append(chunks, chunkNum)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i] < chunks[j]
+	})
+	for _, chunkNum := range chunks {
+		write := pending[chunkNum]
+		var reply shared.Reply
+		args := &shared.Args{
+			Filename:     fname,
+			LocalPath:    dfs.clientName(),
+			Chunknum:     chunkNum,
+			Epoch:        epoch,
+			Data:         write.Data,
+			Version:      write.Base,
+			Disconnected: true,
+		}
+		err = dfs.client().Call("DFSServerInstance.UpdateChunkVersion", args, &reply)
+		if err != nil {
+			return conflicts, DisconnectedError(dfs.server())
+		}
+		if !reply.Writeable {
+			return conflicts, WriteModeTimeoutError(fname)
+		}
+		if reply.Conflict {
+			conflicts = append(conflicts, WriteConflict{
+				Name:   fname,
+				Chunk:  chunkNum,
+				Base:   write.Base,
+				Latest: reply.Version,
+				Data:   write.Data,
+			})
+			if dropConflicts {
+				delete(pending, chunkNum)
+			}
+			continue
+		}
+		writeChunkAt(file, write.Data, len(write.Data), int64(chunkNum)*int64(len(write.Data)))
+		file.Sync()
+		versions[chunkNum] = reply.Version
+		delete(pending, chunkNum)
+	}
+	return conflicts, nil
+}
+
+// Drops the DWRITE writes to fname
+func (dfs *DFSInstance) DiscardWrites(fname string) (err error) {
+	if !isValidPath(fname) {
+		return BadFilenameError(fname)
+	}
+	dfs.pendingMutex.Lock()
+	defer dfs.pendingMutex.Unlock()
+	err = writePending(dfs.LocalPath, fname, nil)
+	if err != nil {
+		return LocalPathError(dfs.LocalPath)
+	}
+	return nil
+}
+
+// Drops the DWRITE write to a chunk once it is overwritten through the server
+func (dfs *DFSInstance) dropWrite(fname string, chunkNum uint32) {
+	dfs.pendingMutex.Lock()
+	defer dfs.pendingMutex.Unlock()
+	pending, err := readPending(dfs.LocalPath, fname)
+	if err != nil {
+		return
+	}
+	if _, exists := pending[chunkNum]; exists {
+		delete(pending, chunkNum)
+		writePending(dfs.LocalPath, fname, pending)
+	}
+}
+
+// Appends a line to the write log
+func (dfs *DFSInstance) appendLog(format string, a ...interface{}) error {
+	dfs.logMutex.Lock()
+	defer dfs.logMutex.Unlock()
+	logFile, err := os.OpenFile(logPath(dfs.LocalPath), os.O_APPEND|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+	_, err = fmt.Fprintf(logFile, format, a...)
+	if err != nil {
+		return err
+	}
+	err = logFile.Sync()
+	if err != nil {
+		return err
+	}
+	if info, err := logFile.Stat(); err == nil && info.Size() > dfs.logLimit {
+		return dfs.rewriteLog(nil)
+	}
+	return nil
+}
+
+// Rewrites the write log with only the writes not complete yet, leaving out those in done
+// Must be called with logMutex held
+func (dfs *DFSInstance) rewriteLog(done map[string]bool) error {
+	writes, err := readLog(dfs.LocalPath)
+	if err != nil {
+		return err
+	}
+	var lines string
+	for _, w := range writes {
+		if !done[w.lines()] {
+			lines += w.lines()
+		}
+	}
+	path := logPath(dfs.LocalPath)
+	err = ioutil.WriteFile(path+".tmp", []byte(lines), 0644)
+	if err != nil {
+		return err
+	}
+	// Large chunks would otherwise have the log rewritten on every write
+	dfs.logLimit = maxLogSize + 2*int64(len(lines))
+	return os.Rename(path+".tmp", path)
+}
+
+// Finishes the writes a crash left incomplete in the write log
+// Chunks the server wasn't told about yet are put back, chunks it was being told about are
+// written again and published by Reconcile unless the server already has them
+// Writes that can't be checked while disconnected stay in the log for the next mount
+func (dfs *DFSInstance) recoverWrites() error {
+	dfs.logMutex.Lock()
+	if _, err := os.Stat(logPath(dfs.LocalPath)); err != nil {
+		// The log is made when a file is first opened
+		dfs.logMutex.Unlock()
+		return nil
+	}
+	writes, err := readLog(dfs.LocalPath)
+	dfs.logMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The log is only held while chunks are put back, not while the server is asked about them
+	done := make(map[string]bool)
+	for _, w := range writes {
+		if dfs.recoverWrite(w) {
+			done[w.lines()] = true
+		}
+	}
+	dfs.logMutex.Lock()
+	defer dfs.logMutex.Unlock()
+	return dfs.rewriteLog(done)
+}
+
+// Puts back or writes again a chunk written before a crash
+// Returns true once the write needs nothing more from the log
+func (dfs *DFSInstance) recoverWrite(w *loggedWrite) bool {
+	chunkSize := len(w.Data)
+	offset := int64(w.Chunk) * int64(chunkSize)
+
+	// Writes the local copy while holding the log, unless the file is open through this mount
+	// and its writes are still going on
+	// Returns true if the file was removed since, and true if the chunk was written
+	writeLocal := func(write func(file *os.File)) (removed bool, ok bool) {
+		dfs.logMutex.Lock()
+		defer dfs.logMutex.Unlock()
+		if dfs.writing(w.Name) {
+			return false, false
+		}
+		file, err := os.OpenFile(filepath.Join(dfs.LocalPath, fmt.Sprintf("%s.dfs", w.Name)), os.O_RDWR, 0644)
+		if err != nil {
+			// The file was removed since
+			return true, false
+		}
+		defer file.Close()
+		write(file)
+		file.Sync()
+		return false, true
+	}
+
+	if !w.Updating {
+		removed, ok := writeLocal(func(file *os.File) {
+			file.WriteAt(w.Old, offset)
+			if w.OldSize < offset+int64(chunkSize) {
+				file.Truncate(w.OldSize)
+			}
+		})
+		return removed || ok
+	}
+
+	// The server may have taken the write, so the chunk keeps it
+	removed, ok := writeLocal(func(file *os.File) {
+		writeChunkAt(file, w.Data, chunkSize, offset)
+	})
+	if removed || !ok {
+		return removed
+	}
+	if !dfs.connected() {
+		return false
+	}
+	var reply shared.Reply
+	args := &shared.Args{
+		Filename:    w.Name,
+		LocalPath:   dfs.clientName(),
+		Chunknum:    w.Chunk,
+		BytesToRead: chunkSize,
+		Offset:      int(offset),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), serverTimeout)
+	defer cancel()
+	err := call(ctx, dfs.client(), "DFSServerInstance.LatestVersion", args, &reply)
+	if err != nil {
+		return false
+	}
+	if reply.Version > w.Base {
+		// Either the server took the write or another client wrote since, the chunk tells which
+		latestVersion := reply.Version
+		reply = shared.Reply{}
+		err = call(ctx, dfs.client(), "DFSServerInstance.Read", args, &reply)
+		if _, refused := err.(rpc.ServerError); refused && latestVersion == w.Base+1 {
+			// Nobody else may have the version, the server took it from us before the crash
+			return dfs.keepRecoveredWrite(ctx, w, latestVersion)
+		}
+		if err != nil {
+			return false
+		}
+		latest := make([]byte, chunkSize)
+		copy(latest, reply.Data)
+		removed, ok := writeLocal(func(file *os.File) {
+			writeChunkAt(file, latest, chunkSize, offset)
+		})
+		if removed || !ok {
+			return removed
+		}
+		dfs.saveVersions(w.Name, chunkSize, map[uint32]int{w.Chunk: reply.Version})
+		if bytes.Equal(latest, w.Data) {
+			return true
+		}
+	}
+
+	// Reconcile publishes the write, or reports a conflict if the chunk changed since
+	dfs.pendingMutex.Lock()
+	defer dfs.pendingMutex.Unlock()
+	pending, err := readPending(dfs.LocalPath, w.Name)
+	if err != nil {
+		return false
+	}
+	pending[w.Chunk] = &pendingWrite{Base: w.Base, Data: w.Data}
+	return writePending(dfs.LocalPath, w.Name, pending) == nil
+}
+
+// Keeps a write the server took before a crash as version of its chunk, if no other client holds
+// that version, and tells the server the local copy has it again since mounting reported the old one
+// Returns true once the write needs nothing more from the log
+func (dfs *DFSInstance) keepRecoveredWrite(ctx context.Context, w *loggedWrite, version int) bool {
+	var reply shared.Reply
+	args := &shared.Args{
+		Filename:  w.Name,
+		LocalPath: dfs.clientName(),
+	}
+	err := call(ctx, dfs.client(), "DFSServerInstance.Stat", args, &reply)
+	if err != nil || !reply.Exists {
+		return false
+	}
+	for holder, versions := range reply.Holders {
+		if holder != dfs.clientName() && versions[w.Chunk] == version {
+			// Another client wrote it, the chunk can be checked once that client is back
+			return false
+		}
+	}
+
+	versions := dfs.localVersions(w.Name)
+	versions[w.Chunk] = version
+	args = &shared.Args{
+		Filename:  w.Name,
+		LocalPath: dfs.clientName(),
+		Versions:  versions,
+		ChunkSize: len(w.Data),
+	}
+	err = call(ctx, dfs.client(), "DFSServerInstance.UpdateServer", args, new(shared.Reply))
+	if err != nil {
+		return false
+	}
+	return dfs.saveVersions(w.Name, len(w.Data), map[uint32]int{w.Chunk: version}) == nil
+}
+
+// Returns the versions of the chunks in the local copy of fname, as saved in its metadata
+func (dfs *DFSInstance) localVersions(fname string) map[uint32]int {
+	meta, err := readMetadata(dfs.LocalPath, fname)
+	if err != nil {
+		return make(map[uint32]int)
 	}
+	return shared.CopyVersions(meta.Versions)
+}
 
-	dfs.FilesOpened = append(dfs.FilesOpened, openFile)
+// Returns true if fname is open in WRITE or CWRITE mode through this mount
+func (dfs *DFSInstance) writing(fname string) bool {
+	dfs.mutex.Lock()
+	defer dfs.mutex.Unlock()
+	for _, f := range dfs.FilesOpened {
+		if f.Name == fname && (f.Mode == WRITE || f.Mode == CWRITE) {
+			return true
+		}
+	}
+	return false
+}
 
-	return openFile, nil
+// Removes a closed file from the open file table
+func (dfs *DFSInstance) forget(file *OpenFile) {
+	dfs.mutex.Lock()
+	defer dfs.mutex.Unlock()
+	for i, f := range dfs.FilesOpened {
+		if f == file {
+			dfs.FilesOpened = append(dfs.FilesOpened[:i], dfs.FilesOpened[i+1:]...)
+			return
+		}
+	}
 }
 
+// Closes open files and stops this mount's goroutines and connections
+// Other mounts in the process are not affected
 func (dfs *DFSInstance) UMountDFS() (err error) {
-	// Return DisconnectedError if not connected
-	if !dfs.Connected {
-		return DisconnectedError(dfs.ServerAddr)
+	// Close open files, giving back write access
+	dfs.mutex.Lock()
+	opened := dfs.FilesOpened
+	dfs.FilesOpened = nil
+	dfs.mutex.Unlock()
+	for _, f := range opened {
+		f.Close()
 	}
 
-	// Close open files
-	if dfs.FilesOpened != nil {
-		for _, f := range dfs.FilesOpened {
-			f.File.Close()
+	// Stop goroutines and close connections, a disconnected mount stops trying to mount again
+	select {
+	case <-dfs.done:
+		return DisconnectedError(dfs.server())
+	default:
+	}
+	dfs.serverMutex.Lock()
+	close(dfs.done)
+	dfs.serverMutex.Unlock()
+	dfs.Listener.Close()
+	dfs.mutex.Lock()
+	for _, conn := range dfs.conns {
+		conn.Close()
+	}
+	dfs.conns = nil
+	for _, channels := range dfs.watchers {
+		for _, ch := range channels {
+			close(ch)
 		}
 	}
-	dfs.FilesOpened = nil
+	dfs.watchers = nil
+	dfs.mutex.Unlock()
 
-	if dfs.Connected {
+	connected := dfs.connected()
+	if connected {
 		var reply shared.Reply
 		args := &shared.Args{
-			LocalPath: dfs.LocalPath,
+			LocalPath: dfs.clientName(),
 		}
-		// Remove all writing access
-		err = dfs.Client.Call("DFSServerInstance.RemoveAccess", args, &reply)
-
 		// Change clients to disconnected and break RPC connections
-		err = dfs.Client.Call("DFSServerInstance.UMountDFS", args, &reply)
-
-		// Close connections
+		err = dfs.client().Call("DFSServerInstance.UMountDFS", args, &reply)
+	}
+	dfs.serverMutex.Lock()
+	if dfs.Client != nil {
 		dfs.Client.Close()
-		dfs.Heartbeat.Close()
 	}
+	dfs.Connected = false
+	dfs.serverMutex.Unlock()
 
+	// Return DisconnectedError if not connected
+	if !connected {
+		return DisconnectedError(dfs.server())
+	}
 	return nil
 }
 
@@ -527,106 +2511,293 @@ type OpenFile struct {
 	Mode      FileMode //Mode that file was opened with
 	Connected bool     //if client gets disconnected while READ/WRITE, no future ops allowed
 	Server    string
-	Versions  [256]int //Version of each chunk
-	Writes    []int    //Chunk nums written to
+	Versions  map[uint32]int //Version of each chunk, missing chunks are version 0
+	Writes    []int          //Chunk nums written to
+
+	BytesPerChunk int //Chunk size the file was created with
 
-	Client    *rpc.Client // To call server, need to be able to update server at file close
 	LocalPath string
+	Epoch     int // Epoch of the write lease, WRITE mode only
+
+	mount      *DFSInstance      // Mount the file was opened through
+	leases     map[int]time.Time // When the write lease or each chunk lock runs out unless renewed, by epoch
+	chunkLocks []chunkLock       // Chunk locks held in CWRITE mode
+	leaseMutex sync.Mutex        // Protects leases, chunkLocks and stopRenew
+	stopRenew  chan struct{}     // Closed by Close to stop renewing leases
+}
+
+// Chunks first to last locked for writing in CWRITE mode
+type chunkLock struct {
+	first uint32
+	last  uint32
+	epoch int
+}
+
+// Renews the write lease and chunk locks until the file is closed
+// Leases the server refuses to renew run out and writes return WriteModeTimeoutError
+func (f *OpenFile) renewLease(duration time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(duration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		f.leaseMutex.Lock()
+		var epochs []int
+		for epoch := range f.leases {
+			epochs = append(epochs, epoch)
+		}
+		f.leaseMutex.Unlock()
+
+		for _, epoch := range epochs {
+			sent := time.Now()
+			var reply shared.Reply
+			args := &shared.Args{
+				Filename:  f.Name,
+				LocalPath: f.mount.clientName(),
+				Epoch:     epoch,
+			}
+			err := f.mount.client().Call("DFSServerInstance.RenewLease", args, &reply)
+			if err != nil || !reply.Writeable {
+				continue
+			}
+			f.leaseMutex.Lock()
+			if _, held := f.leases[epoch]; held {
+				f.leases[epoch] = sent.Add(reply.Lease)
+			}
+			f.leaseMutex.Unlock()
+		}
+	}
+}
+
+// Returns true if the write lease or chunk lock of epoch has not run out
+func (f *OpenFile) leaseValid(epoch int) bool {
+	f.leaseMutex.Lock()
+	defer f.leaseMutex.Unlock()
+	return time.Now().Before(f.leases[epoch])
+}
+
+// Returns the epoch of the chunk lock covering chunkNum, 0 if there is none
+func (f *OpenFile) chunkLockEpoch(chunkNum uint32) int {
+	f.leaseMutex.Lock()
+	defer f.leaseMutex.Unlock()
+	for _, lock := range f.chunkLocks {
+		if lock.first <= chunkNum && chunkNum <= lock.last {
+			return lock.epoch
+		}
+	}
+	return 0
+}
+
+// Locks chunks first to last for writing in CWRITE mode
+func (f *OpenFile) LockChunks(first uint32, last uint32) (err error) {
+	if f.Mode != CWRITE {
+		return BadFileModeError(f.Mode)
+	}
+	if !f.Connected {
+		return DisconnectedError(f.Server)
+	}
+	if first > last {
+		return ChunkNotLockedError(first)
+	}
+
+	sent := time.Now()
+	var reply shared.Reply
+	args := &shared.Args{
+		Filename:  f.Name,
+		LocalPath: f.mount.clientName(),
+		Chunknum:  first,
+		LastChunk: last,
+	}
+	err = f.mount.client().Call("DFSServerInstance.LockChunks", args, &reply)
+	if err != nil {
+		return DisconnectedError(f.Server)
+	}
+	if !reply.Writeable {
+		return ChunkLockConflictError(f.Name)
+	}
+
+	f.leaseMutex.Lock()
+	defer f.leaseMutex.Unlock()
+	f.chunkLocks = append(f.chunkLocks, chunkLock{first: first, last: last, epoch: reply.Epoch})
+	if f.leases == nil {
+		f.leases = make(map[int]time.Time)
+	}
+	f.leases[reply.Epoch] = sent.Add(reply.Lease)
+	if f.stopRenew == nil {
+		f.stopRenew = make(chan struct{})
+		go f.renewLease(reply.Lease, f.stopRenew)
+	}
+	return nil
+}
+
+// Releases chunk locks within first to last in CWRITE mode
+func (f *OpenFile) UnlockChunks(first uint32, last uint32) (err error) {
+	if f.Mode != CWRITE {
+		return BadFileModeError(f.Mode)
+	}
+	if !f.Connected {
+		return DisconnectedError(f.Server)
+	}
+
+	f.leaseMutex.Lock()
+	var kept, released []chunkLock
+	for _, lock := range f.chunkLocks {
+		if first <= lock.first && lock.last <= last {
+			released = append(released, lock)
+			delete(f.leases, lock.epoch)
+		} else {
+			kept = append(kept, lock)
+		}
+	}
+	f.chunkLocks = kept
+	f.leaseMutex.Unlock()
+
+	for _, lock := range released {
+		var reply shared.Reply
+		args := &shared.Args{
+			Filename:  f.Name,
+			LocalPath: f.mount.clientName(),
+			Epoch:     lock.epoch,
+		}
+		if f.mount.client().Call("DFSServerInstance.UnlockChunks", args, &reply) != nil {
+			err = DisconnectedError(f.Server)
+		}
+	}
+	return err
+}
+
+// Returns the number of bytes in each chunk of the file
+func (f *OpenFile) ChunkSize() int {
+	return f.BytesPerChunk
+}
+
+// Reads a legacy fixed size chunk
+func (f *OpenFile) Read(chunkNum uint32, chunk *Chunk) (err error) {
+	return f.readChunk(context.Background(), chunkNum, chunk[:])
+}
+
+// Read that gives up when ctx is done
+func (f *OpenFile) ReadContext(ctx context.Context, chunkNum uint32, chunk *Chunk) (err error) {
+	return f.readChunk(ctx, chunkNum, chunk[:])
+}
+
+// Reads a chunk of the file's chunk size
+func (f *OpenFile) ReadChunk(chunkNum uint32, chunk []byte) (err error) {
+	return f.readChunk(context.Background(), chunkNum, chunk)
 }
 
 //If disconnected, return DisconnectedError
 // Return ChunkUnavailableError(chunk num)
-func (f *OpenFile) Read(chunkNum uint8, chunk *Chunk) (err error) {
+func (f *OpenFile) readChunk(ctx context.Context, chunkNum uint32, chunk []byte) (err error) {
 	// If disconnected, return DisconnectedError
-	if !f.Connected {
+	if !f.Connected && !f.offline() {
 		return DisconnectedError(f.Server)
 	}
 
-	// File can only have 256 chunks
-	if int(chunkNum) < 0 || int(chunkNum) > 255 {
-		return ChunkUnavailableError(chunkNum)
+	if len(chunk) != f.BytesPerChunk {
+		return BadChunkSizeError(len(chunk))
 	}
 
 	// Get offset into file
-	seek := int64(chunkNum * 32)
+	seek := int64(chunkNum) * int64(f.BytesPerChunk)
 
-	// if dread mode read from file
-	if f.Mode == DREAD {
-		_, err = f.File.ReadAt(chunk[:], seek)
-		if err != nil {
-			//fmt.Printf("error:%s\n", err) //delete
-			return ChunkUnavailableError(chunkNum)
-		}
-	} else {
+	// In READ/WRITE mode make sure the local chunk is the latest version
+	if !f.offline() {
 		// See if chunk version needs to be updated
 		var reply shared.Reply
 		args := &shared.Args{
 			Filename: f.Name,
 			Chunknum: chunkNum,
 		}
-		err = f.Client.Call("DFSServerInstance.LatestVersion", args, &reply)
-		//fmt.Printf("LATEST VERSION ON SERVER:%d, OUR VERSION:%d\n", reply.Version, f.Versions[int(chunkNum)]) //delete
+		err = call(ctx, f.mount.client(), "DFSServerInstance.LatestVersion", args, &reply)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		//fmt.Printf("LATEST VERSION ON SERVER:%d, OUR VERSION:%d\n", reply.Version, f.Versions[chunkNum]) //delete
 
 		// If it does, get chunk from server
-		if reply.Version > f.Versions[int(chunkNum)] {
+		if reply.Version > f.Versions[chunkNum] {
 			var reply shared.Reply
 			args := &shared.Args{
 				Filename:    f.Name,
-				LocalPath:   f.LocalPath,
-				BytesToRead: 32,
+				LocalPath:   f.mount.clientName(),
+				BytesToRead: f.BytesPerChunk,
 				Offset:      int(seek),
 				Chunknum:    chunkNum,
 				Mode:        int(f.Mode),
 				Open:        false,
 			}
 			// Get Chunk
-			err = f.Client.Call("DFSServerInstance.Read", args, &reply)
+			err = call(ctx, f.mount.client(), "DFSServerInstance.Read", args, &reply)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if err != nil {
 				//fmt.Printf("1. chunk unavailable error:%s\n", err) //delete
 				return ChunkUnavailableError(chunkNum)
 			}
 
 			// Update file and version read in file metadata
-			f.Versions[int(chunkNum)] = reply.Version
-			_, err = f.File.WriteAt(reply.Chunk[:], seek)
+			f.Versions[chunkNum] = reply.Version
+			err = writeChunkAt(f.File, reply.Data, f.BytesPerChunk, seek)
 			if err != nil {
 				//fmt.Println("Error occured writing chunk to file")
 			}
 			// Save read part to disk
-			f.File.Truncate(int64(256 * 32))
 			f.File.Sync()
+			f.mount.saveVersions(f.Name, f.BytesPerChunk, map[uint32]int{chunkNum: reply.Version})
 		}
 	}
 
-	n, err := f.File.ReadAt(chunk[:], seek)
-	count := 0
-	if err != nil {
-		for _, byte := range chunk[:] {
-			if byte != 0 {
-				count += 1
+	// DWRITE reads see the writes not published yet
+	if f.Mode == DWRITE {
+		f.mount.pendingMutex.Lock()
+		pending, _ := readPending(f.LocalPath, f.Name)
+		f.mount.pendingMutex.Unlock()
+		if write, exists := pending[chunkNum]; exists {
+			n := copy(chunk, write.Data)
+			for i := n; i < len(chunk); i++ {
+				chunk[i] = 0
 			}
-		}
-		// Chunk is empty
-		if n == 0 && count == 0 {
 			return nil
 		}
+	}
 
-		// Chunk is not empty but we reached EOF
-		if count > 0 {
-			_, err := f.File.ReadAt(chunk[:count], seek)
-			if err != nil {
-				return nil
-			}
-
-		}
+	// Anything past the end of the local file reads as zeroes
+	n, err := f.File.ReadAt(chunk, seek)
+	if err != nil && err != io.EOF {
 		return ChunkUnavailableError(chunkNum)
 	}
+	for i := n; i < len(chunk); i++ {
+		chunk[i] = 0
+	}
 	return nil
 }
 
-func (f *OpenFile) Write(chunkNum uint8, chunk *Chunk) (err error) {
+// Writes a legacy fixed size chunk
+func (f *OpenFile) Write(chunkNum uint32, chunk *Chunk) (err error) {
+	return f.writeChunk(context.Background(), chunkNum, chunk[:])
+}
+
+// Write that gives up when ctx is done
+// The chunk may already be written locally, the log records that the server wasn't told
+// and the next mount finishes the write
+func (f *OpenFile) WriteContext(ctx context.Context, chunkNum uint32, chunk *Chunk) (err error) {
+	return f.writeChunk(ctx, chunkNum, chunk[:])
+}
+
+// Writes a chunk of the file's chunk size
+func (f *OpenFile) WriteChunk(chunkNum uint32, chunk []byte) (err error) {
+	return f.writeChunk(context.Background(), chunkNum, chunk)
+}
+
+func (f *OpenFile) writeChunk(ctx context.Context, chunkNum uint32, chunk []byte) (err error) {
 	// If disconnected, return DisconnectedError
-	if !f.Connected {
+	if !f.Connected && f.Mode != DWRITE {
 		return DisconnectedError(f.Server)
 	}
 
@@ -635,87 +2806,230 @@ func (f *OpenFile) Write(chunkNum uint8, chunk *Chunk) (err error) {
 		return BadFileModeError(f.Mode)
 	}
 
-	var reply shared.Reply
-	args := &shared.Args{
-		LocalPath: f.LocalPath,
-	}
-	err = f.Client.Call("DFSServerInstance.HeartbeatDisconnectExist", args, &reply)
-	if reply.Exists {
-		return WriteModeTimeoutError(f.Name)
+	if len(chunk) != f.BytesPerChunk {
+		return BadChunkSizeError(len(chunk))
 	}
 
-	// Update log that it needs to write
-	ext := fmt.Sprintf("%s.dfs", "log")
-	log := filepath.Join(f.LocalPath, ext)
-	logFile, err := os.OpenFile(log, os.O_APPEND|os.O_RDWR, 0644)
-	defer logFile.Close()
-	if err != nil {
-		//fmt.Print("Error opening log file to record write.") //delete
+	if f.Mode == DWRITE {
+		return f.keepWrite(chunkNum, chunk)
 	}
 
-	// Actual number of things to write
-	count := 0
-	for _, byte := range chunk[:] {
-		if byte != 0 {
-			count += 1
+	// In CWRITE mode the chunk must be locked
+	epoch := f.Epoch
+	if f.Mode == CWRITE {
+		epoch = f.chunkLockEpoch(chunkNum)
+		if epoch == 0 {
+			return ChunkNotLockedError(chunkNum)
 		}
 	}
 
-	msg := fmt.Sprintf("WRITING: %d, %s\n", int(chunkNum), (chunk[:count]))
-	_, err = logFile.WriteString(msg)
-	logFile.Sync()
+	// Don't touch the local copy once another client may have the file
+	if !f.leaseValid(epoch) {
+		return WriteModeTimeoutError(f.Name)
+	}
+
+	// Keep what the chunk held in case the server refuses the write or we crash
+	offset := int64(chunkNum) * int64(f.BytesPerChunk)
+	old := make([]byte, f.BytesPerChunk)
+	oldLen, _ := f.File.ReadAt(old, offset)
+	var oldSize int64
+	if info, err := f.File.Stat(); err == nil {
+		oldSize = info.Size()
+	}
+
+	// Update log that it needs to write
+	logged := &loggedWrite{
+		Name:    f.Name,
+		Chunk:   chunkNum,
+		Base:    f.Versions[chunkNum],
+		OldSize: oldSize,
+		Old:     old[:oldLen],
+		Data:    chunk,
+	}
+	f.mount.appendLog("%s", logged.lines())
 
 	// Write
-	offset := int64(chunkNum * 32)
-	f.File.WriteAt(chunk[:count], offset)
+	f.File.WriteAt(chunk[:chunkExtent(f.File, chunk, offset)], offset)
 	f.File.Sync()
 
 	//Update log that write complete, but needs to update server
-	msg = fmt.Sprintf("SERVER FILES UPDATING: %d, %s\n", int(chunkNum), chunk[:count])
-	_, err = logFile.WriteString(msg)
-	logFile.Sync()
+	f.mount.appendLog("SERVER FILES UPDATING: %d, %s\n", chunkNum, f.Name)
 
 	// Update Server
-	reply = shared.Reply{}
-	args = &shared.Args{
+	var reply shared.Reply
+	args := &shared.Args{
 		Filename:  f.Name,
-		LocalPath: f.LocalPath,
+		LocalPath: f.mount.clientName(),
 		Chunknum:  chunkNum,
+		Epoch:     epoch,
+		Data:      chunk,
+	}
+	err = call(ctx, f.mount.client(), "DFSServerInstance.UpdateChunkVersion", args, &reply)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil || !reply.Writeable {
+		// Put the chunk back, the server kept the old version
+		f.File.WriteAt(old[:oldLen], offset)
+		if oldSize < offset+int64(f.BytesPerChunk) {
+			f.File.Truncate(oldSize)
+		}
+		f.File.Sync()
+		f.mount.appendLog("WRITE REVERTED: %d, %s\n", chunkNum, f.Name)
+		if err != nil {
+			return DisconnectedError(f.Server)
+		}
+		return WriteModeTimeoutError(f.Name)
 	}
-	err = f.Client.Call("DFSServerInstance.UpdateChunkVersion", args, &reply)
 
 	// Update self
 	version := reply.Version
-	newVersions := f.Versions
-	newVersions[int(chunkNum)] = version
-	f.Versions = newVersions
+	f.Versions[chunkNum] = version
+	f.mount.saveVersions(f.Name, f.BytesPerChunk, map[uint32]int{chunkNum: version})
+
+	// A DWRITE write to the chunk is overwritten
+	f.mount.dropWrite(f.Name, chunkNum)
 
 	// Update log that write complete
-	msg = fmt.Sprintf("WRITE COMPLETE\n")
-	_, err = logFile.WriteString(msg)
-	logFile.Sync()
+	f.mount.appendLog("WRITE COMPLETE: %d, %s\n", chunkNum, f.Name)
+
+	return nil
+
+}
 
+// Saves a DWRITE write in the file's journal for Reconcile to publish
+// The first write to a chunk records the version of the local copy it is made against
+func (f *OpenFile) keepWrite(chunkNum uint32, chunk []byte) error {
+	f.mount.pendingMutex.Lock()
+	defer f.mount.pendingMutex.Unlock()
+	pending, err := readPending(f.LocalPath, f.Name)
+	if err != nil {
+		return LocalPathError(f.LocalPath)
+	}
+	write, exists := pending[chunkNum]
+	if !exists {
+		write = &pendingWrite{Base: f.Versions[chunkNum]}
+		pending[chunkNum] = write
+	}
+	write.Data = append([]byte(nil), chunk...)
+	err = writePending(f.LocalPath, f.Name, pending)
+	if err != nil {
+		return LocalPathError(f.LocalPath)
+	}
 	return nil
+}
+
+// Returns true if the file is read, and written, without the server
+func (f *OpenFile) offline() bool {
+	return f.Mode == DREAD || f.Mode == DWRITE
+}
+
+// Returns how many bytes of chunk need to be written at offset
+// Trailing zeroes past the end of the file are left implicit, but
+// inside the file the whole chunk is written so old data is replaced
+func chunkExtent(file *os.File, chunk []byte, offset int64) int {
+	extent := 0
+	for i, b := range chunk {
+		if b != 0 {
+			extent = i + 1
+		}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return len(chunk)
+	}
+	if inFile := info.Size() - offset; inFile > int64(extent) {
+		if inFile > int64(len(chunk)) {
+			return len(chunk)
+		}
+		return int(inFile)
+	}
+	return extent
+}
+
+// Saves chunk data fetched from another client at offset
+// Data shorter than chunkSize is padded with zeroes
+func writeChunkAt(file *os.File, data []byte, chunkSize int, offset int64) error {
+	chunk := make([]byte, chunkSize)
+	copy(chunk, data)
+	_, err := file.WriteAt(chunk[:chunkExtent(file, chunk, offset)], offset)
+	return err
+}
+
+// Returns the length of the file in bytes
+// In READ/WRITE mode chunks written by other clients count even if
+// they have not been fetched yet
+func (f *OpenFile) size() (int64, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if f.offline() || !f.Connected {
+		return size, nil
+	}
 
+	var reply shared.Reply
+	args := &shared.Args{
+		Filename: f.Name,
+	}
+	err = f.mount.client().Call("DFSServerInstance.LatestVersions", args, &reply)
+	if err != nil {
+		return 0, DisconnectedError(f.Server)
+	}
+	for chunkNum, version := range reply.Versions {
+		if end := (int64(chunkNum) + 1) * int64(f.BytesPerChunk); version > 0 && end > size {
+			size = end
+		}
+	}
+	return size, nil
 }
 
 func (f *OpenFile) Close() (err error) {
+	return f.CloseContext(context.Background())
+}
+
+// Close that stops waiting for the server when ctx is done
+// The local file is closed either way
+func (f *OpenFile) CloseContext(ctx context.Context) (err error) {
 	// If Mode = READ/WRITE and disconnected, return DisconnectedError
-	if !f.Connected && f.Mode != DREAD {
+	if !f.Connected && !f.offline() {
 		return DisconnectedError(f.Server)
 	}
 
+	f.leaseMutex.Lock()
+	if f.stopRenew != nil {
+		close(f.stopRenew)
+		f.stopRenew = nil
+	}
+	f.leaseMutex.Unlock()
+
+	if f.Mode == CWRITE && f.Connected {
+		// Release chunk locks
+		f.UnlockChunks(0, ^uint32(0))
+	}
+
 	if f.Mode == WRITE && f.Connected {
 		var reply shared.Reply
 		args := &shared.Args{
 			Filename:  f.Name,
-			LocalPath: f.LocalPath,
+			LocalPath: f.mount.clientName(),
+			Epoch:     f.Epoch,
 		}
 		// If WRITE, remove writing access block
-		err = f.Client.Call("DFSServerInstance.RemoveAccess", args, &reply)
+		err = call(ctx, f.mount.client(), "DFSServerInstance.RemoveAccess", args, &reply)
 	}
 
 	f.File.Close()
+	if f.mount != nil {
+		f.mount.forget(f)
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	} else if err != nil {
+		// The lease runs out on the server instead
+		return DisconnectedError(f.Server)
+	}
 	return nil
 }
 
@@ -725,25 +3039,34 @@ func (f *OpenFile) Close() (err error) {
 // local filesystem where the client has allocated storage (and
 // possibly existing state) for this DFS.
 //
-// The returned dfs instance is singleton: an application is expected
-// to interact with just one dfs at a time.
+// Each call returns an independent dfs instance with its own
+// connections, heartbeat and open files, so an application can mount
+// several servers or local paths at once and unmount them separately.
+//
+// serverAddr may list several servers separated by commas, such as the
+// members of a raft group. The first one that accepts the connection is
+// mounted on, and the mount fails over to the others when it stops
+// answering, which follows the group's leader since only it accepts
+// clients.
 //
 // This call should succeed regardless of whether the server is
 // reachable. Otherwise, applications cannot access (local) files
-// while disconnected.
+// while disconnected. A mount that is disconnected, at first or
+// after its servers stop answering, keeps trying to mount again in
+// the background and becomes connected without being remounted.
 //
 // Can return the following errors:
 // - LocalPathError
 // - Networking errors related to localIP or serverAddr
 
 func MountDFS(serverAddr string, localIP string, localPath string) (dfs DFS, err error) {
-	//TODO if client reconnects, need to update server - look through for disconnected servers with same local path and create a file with unique id and during mount, check that localPath for that file
-
-	// Same client has unique local paths, different clients can have same local patho
-	// Get disconnected clients
-	// Compare name
-	// Compare files in local path
+	return MountDFSContext(context.Background(), serverAddr, localIP, localPath)
+}
 
+// MountDFS that gives up connecting to the server when ctx is done. Unlike
+// an unreachable server, which gives a disconnected DFS, this returns
+// ctx.Err() (context.Canceled or context.DeadlineExceeded).
+func MountDFSContext(ctx context.Context, serverAddr string, localIP string, localPath string) (dfs DFS, err error) {
 	connected := true
 
 	// If path does not exist, return LocalPathError
@@ -752,123 +3075,243 @@ func MountDFS(serverAddr string, localIP string, localPath string) (dfs DFS, err
 		return nil, LocalPathError(localPath)
 	}
 
+	// Different clients can have the same local path, the uuid tells a returning client apart
+	uuid, err := clientUUID(localPath)
+	if err != nil {
+		return nil, LocalPathError(localPath)
+	}
+
 	// Get addresses
-	server, _ := net.ResolveTCPAddr("tcp", serverAddr)
 	formatted := fmt.Sprintf("%s:0", localIP)
 	local, err := net.ResolveTCPAddr("tcp", formatted)
 
-	// Connect to the server, ignore connection errors
+	// Connect to the first server that answers, ignore connection errors
 	//fmt.Printf("These are the things: local:%s, server:%s\n", local, server)
-	conn, err := net.DialTCP("tcp", local, server)
+	dialer := &net.Dialer{LocalAddr: local}
+	seeds := strings.Split(serverAddr, ",")
+	var conn net.Conn
+	for _, addr := range seeds {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			serverAddr = addr
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if conn == nil {
+		serverAddr = seeds[0]
+	}
 
-	var dfsClient *DFSInstance
+	// Listen for rpc messages from RPC server
+	listener, err := net.ListenTCP("tcp", local)
 	if err != nil {
+		//fmt.Println("Error occurred listening to rpc client: ", err) //delete connected = false
+		if conn != nil {
+			conn.Close()
+		}
+		return nil, err
+	}
+	dfsInstance := new(ClientInstance)
+	rpcServer := rpc.NewServer()
+	rpcServer.Register(dfsInstance)
+
+	// Register self as a DFS Client Instance
+	dfsClient := &DFSInstance{
+		LocalPath:  localPath,
+		IPAddr:     local.String(),
+		ServerAddr: serverAddr,
+		Server:     rpcServer,
+		Listener:   listener,
+		UUID:       uuid,
+		watchers:   make(map[string][]chan ChangeEvent),
+		done:       make(chan struct{}),
+		seeds:      seeds,
+		logLimit:   maxLogSize,
+		name:       localPath,
+	}
+	dfsInstance.mount = dfsClient
+	dfsClient.serverMutex.Lock()
+	dfsClient.setServers(nil)
+	dfsClient.serverMutex.Unlock()
+
+	// Serve in another goroutine
+	go dfsClient.serveServer()
+
+	if conn == nil {
 		// If it can't connect to server, then it's disconnected
 		//fmt.Println("Couldn't connect to tcp: ", err)
 		connected = false
 	} else {
 		//Otherwise
 		// Get client address of connection
-		addr := conn.LocalAddr()
-
-		// Listen for rpc messages from RPC server
-		dfsInstance := new(ClientInstance)
-		rpcServer := rpc.NewServer()
-		rpcServer.Register(dfsInstance)
-
-		//str := fmt.Sprintf("%s:0", localIP)
-		//hhp, err := net.ResolveTCPAddr("tcp", str)
-		listener, err := net.ListenTCP("tcp", local)
-		if err != nil {
-			//fmt.Println("Error occurred listening to rpc client: ", err) //delete connected = false
-			return nil, err
-
-		}
-
-		//go rpcServer.Accept(listener)
-		// Serve in another goroutine
-		go func() {
-			for {
-				// Accept connections and block until listener receives non-nil error
-				accept, err := listener.Accept()
-				if err != nil {
-					continue
-				}
-				go rpcServer.ServeConn(accept)
-			}
-		}()
-
-		// Register self as a DFS Client Instance
-		dfsClient = &DFSInstance{
-			Client:     rpc.NewClient(conn),
-			LocalPath:  localPath,
-			IPAddr:     addr.String(),
-			ServerAddr: serverAddr,
-			Server:     rpcServer,
-			Connected:  connected,
-		}
-
-		// Check if it has mounted before
+		dfsClient.IPAddr = conn.LocalAddr().String()
+		dfsClient.Client = rpc.NewClient(conn)
 
-		// Register client to server
+		// Register client to server, server calls back on the rpc listener
 		var reply shared.Reply
 		args := &shared.Args{
 			LocalPath:  localPath,
-			Addr:       addr.String(),
+			Addr:       listener.Addr().String(),
 			ServerAddr: serverAddr,
+			UUID:       uuid,
+			Files:      dfsClient.inventory(),
+		}
+		err = call(ctx, dfsClient.Client, "DFSServerInstance.Mount", args, &reply)
+		if ctx.Err() != nil {
+			close(dfsClient.done)
+			dfsClient.Client.Close()
+			listener.Close()
+			return nil, ctx.Err()
 		}
-		err = dfsClient.Client.Call("DFSServerInstance.Mount", args, &reply)
 		if err != nil {
 			//fmt.Println("error occurred during rpc mounting call") //delete
-			dfsClient.Connected = false
-			//return nil, err
+			connected = false
 		}
 
-		/* ignore this
-		//fmt.Printf("Client %d is Connected\n", reply.ID) //delete
-		// Get new assigned LocalPath
-		dfsClient.LocalPath = reply.LocalPath
-
-		// Create a local path for the client
-		//os.Mkdir(dfsClient.LocalPath, 0700)
-		*/
+		// Catch up on files removed or renamed while we were away
+		for _, change := range reply.Changes {
+			applyNamespaceChange(localPath, change)
+		}
+		dfsClient.serverMutex.Lock()
+		dfsClient.Connected = connected
+		if connected {
+			dfsClient.name = reply.LocalPath
+		}
+		dfsClient.setServers(reply.Servers)
+		dfsClient.serverMutex.Unlock()
+	}
 
-		// Start sending UDP Heartbeat
-		go dfsClient.SendUDPHeartbeat(localPath)
+	// Start sending UDP Heartbeat
+	go dfsClient.SendUDPHeartbeat(localPath)
 
-		return dfsClient, nil
-	}
+	// Move to the backup server if this one fails, or mount once a server answers
+	go dfsClient.watchServer()
 
-	// When not connected
-	// Register self as a DFS Client Instance
-	dfsClient = &DFSInstance{
-		LocalPath:  localPath,
-		ServerAddr: serverAddr,
-		Connected:  false,
+	// Finish writes cut short by a crash, those the server may have missed are published with the offline ones
+	dfsClient.recoverWrites()
+	if connected {
+		// Publish writes made offline, conflicts wait for the app to call Reconcile
+		dfsClient.publishWrites(false)
 	}
 	return dfsClient, nil
 }
 
-type ClientInstance int
+// Receives rpc calls from the server on behalf of one mount
+type ClientInstance struct {
+	mount *DFSInstance
+}
 
 // Returns a chunk of file from client
 func (d *ClientInstance) GetChunk(args *shared.Args, reply *shared.Reply) (err error) {
 	// Open file
 	ext := fmt.Sprintf("%s.dfs", args.Filename)
-	fullPath := filepath.Join(args.LocalPath, ext)
+	fullPath := filepath.Join(d.mount.LocalPath, ext)
 	file, err := os.Open(fullPath)
 	if err != nil {
 		//fmt.Println("Error opening file")
 		return errors.New("Error opening file")
 
 	}
-	chunk := make([]byte, 32)
-	_, err = file.ReadAt(chunk, int64(args.Offset))
-	if err != nil {
+	defer file.Close()
+	chunk := make([]byte, args.BytesToRead)
+	n, err := file.ReadAt(chunk, int64(args.Offset))
+	if err != nil && err != io.EOF {
 		//fmt.Println("There was a problem reading the chunk:", err) //delete
 		return errors.New("Error reading chunk")
 	}
 	// Return data read
-	copy(reply.Chunk[:], chunk)
+	reply.Data = chunk[:n]
+	return nil
+}
+
+// Saves a chunk version the server pushes to keep enough copies of it
+// Files open for writing are refused, their local copy is the writer's
+func (d *ClientInstance) StoreChunk(args *shared.Args, reply *shared.Reply) (err error) {
+	if d.mount.writing(args.Filename) {
+		return errors.New("Error because file is open for writing")
+	}
+
+	// Create the file if this client never had it
+	ext := fmt.Sprintf("%s.dfs", args.Filename)
+	fullPath := filepath.Join(d.mount.LocalPath, ext)
+	os.MkdirAll(filepath.Dir(fullPath), 0755)
+	file, err := os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.New("Error opening file")
+	}
+	defer file.Close()
+
+	err = writeChunkAt(file, args.Data, args.ChunkSize, int64(args.Chunknum)*int64(args.ChunkSize))
+	if err != nil {
+		return errors.New("Error writing chunk")
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	return d.mount.saveVersions(args.Filename, args.ChunkSize, map[uint32]int{args.Chunknum: args.Version})
+}
+
+// Passes a chunk write to the channels watching the file
+func (d *ClientInstance) NotifyChange(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mount.notify(ChangeEvent{
+		Name:    args.Filename,
+		Chunk:   args.Chunknum,
+		Version: args.Version,
+		Writer:  args.Writer,
+	})
+	return nil
+}
+
+// Server announces the servers to fail over to when its backup changes
+func (d *ClientInstance) UpdateServers(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mount.serverMutex.Lock()
+	defer d.mount.serverMutex.Unlock()
+	d.mount.setServers(args.Servers)
 	return nil
 }
+
+// Removes or renames a file in the client's local path
+func (d *ClientInstance) ApplyNamespaceChange(args *shared.Args, reply *shared.Reply) (err error) {
+	change := shared.NamespaceChange{
+		Filename: args.Filename,
+		NewName:  args.NewName,
+	}
+	d.mount.moveWatchers(change)
+	return applyNamespaceChange(d.mount.LocalPath, change)
+}
+
+// Removes or renames the local copy of a file along with its metadata
+// Files that have no local copy are ignored
+func applyNamespaceChange(localPath string, change shared.NamespaceChange) error {
+	chunks := filepath.Join(localPath, fmt.Sprintf("%s.dfs", change.Filename))
+	if change.NewName == "" {
+		os.Remove(metadataPath(localPath, change.Filename))
+		os.Remove(pendingPath(localPath, change.Filename))
+		err := os.Remove(chunks)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	newChunks := filepath.Join(localPath, fmt.Sprintf("%s.dfs", change.NewName))
+	os.MkdirAll(filepath.Dir(newChunks), 0755)
+	err := os.Rename(chunks, newChunks)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	os.Rename(pendingPath(localPath, change.Filename), pendingPath(localPath, change.NewName))
+
+	meta, err := readMetadata(localPath, change.Filename)
+	if err != nil {
+		return nil
+	}
+	os.Remove(metadataPath(localPath, change.Filename))
+	meta.Name = change.NewName
+	return writeMetadata(localPath, meta)
+}
@@ -0,0 +1,172 @@
+/*
+ * Test of writes made in DWRITE mode while disconnected, and of Reconcile
+ * publishing them:
+ *
+ * $ go run -race server.go 127.0.0.1:8080 [data directory] -store
+ * $ go run -race dwrite_app.go 127.0.0.1:8080
+ *
+ * The server keeps a copy of the chunks written so the other client can
+ * open the file while the one writing in DWRITE mode is disconnected.
+ * - A client mounted without a server can write its local copy in DWRITE
+ *   mode and read the writes back, Reconcile fails while it is disconnected
+ * - Once it mounts again its writes are published, except those to chunks
+ *   another client wrote meanwhile, which Reconcile returns as conflicts
+ * - A conflict is only returned once, and DiscardWrites drops writes that
+ *   are not published yet
+ */
+
+package main
+
+import (
+	"./dfslib"
+
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Address nothing listens on, mounting there gives a disconnected DFS
+const offlineAddr = "127.0.0.1:1"
+
+// Returns chunk holding content
+func chunkOf(content string) *dfslib.Chunk {
+	var chunk dfslib.Chunk
+	copy(chunk[:], content)
+	return &chunk
+}
+
+// Writes contents to the chunks of fname in mode
+func write(dfs dfslib.DFS, fname string, mode dfslib.FileMode, contents map[uint32]string) error {
+	f, err := dfs.Open(fname, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for chunkNum, content := range contents {
+		err = f.Write(chunkNum, chunkOf(content))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks the chunks of fname opened in mode hold contents
+func read(dfs dfslib.DFS, fname string, mode dfslib.FileMode, contents map[uint32]string) error {
+	f, err := dfs.Open(fname, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for chunkNum, content := range contents {
+		var chunk dfslib.Chunk
+		err = f.Read(chunkNum, &chunk)
+		if err != nil {
+			return err
+		}
+		if chunk != *chunkOf(content) {
+			return fmt.Errorf("chunk %d holds %q, expected %q", chunkNum, string(chunk[:len(content)]), content)
+		}
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Println("Usage: go run -race dwrite_app.go [server host:ip]")
+		return
+	}
+	serverAddr := os.Args[1]
+	dir, err := ioutil.TempDir("", "dwrite")
+	if err != nil {
+		panic("Could not create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	pathA := filepath.Join(dir, "a")
+	pathB := filepath.Join(dir, "b")
+	os.Mkdir(pathA, 0755)
+	os.Mkdir(pathB, 0755)
+
+	failed := false
+	check := func(description string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("ERROR %s: %v\n", description, err)
+		} else {
+			fmt.Printf("OK %s\n", description)
+		}
+	}
+
+	a, err := dfslib.MountDFS(serverAddr, "127.0.0.1", pathA)
+	if err != nil {
+		fmt.Println("Error: Could not mount:", err)
+		os.Exit(1)
+	}
+	check("write the file connected", write(a, "doc", dfslib.WRITE, map[uint32]string{0: "first 0", 1: "first 1", 2: "first 2"}))
+	a.UMountDFS()
+
+	// The same local path mounted without a server
+	offline, _ := dfslib.MountDFS(offlineAddr, "127.0.0.1", pathA)
+	_, err = offline.Open("missing", dfslib.DWRITE)
+	if _, ok := err.(dfslib.FileDoesNotExistError); ok {
+		err = nil
+	} else {
+		err = fmt.Errorf("got %v", err)
+	}
+	check("DWRITE needs a local copy", err)
+	check("write in DWRITE mode while disconnected", write(offline, "doc", dfslib.DWRITE, map[uint32]string{1: "offline 1", 2: "offline 2"}))
+	check("read the DWRITE writes back", read(offline, "doc", dfslib.DWRITE, map[uint32]string{0: "first 0", 1: "offline 1", 2: "offline 2"}))
+	_, err = offline.Reconcile()
+	if _, ok := err.(dfslib.DisconnectedError); ok {
+		err = nil
+	} else {
+		err = fmt.Errorf("got %v", err)
+	}
+	check("Reconcile fails while disconnected", err)
+	offline.UMountDFS()
+
+	// Another client writes chunk 2 meanwhile
+	b, err := dfslib.MountDFS(serverAddr, "127.0.0.1", pathB)
+	if err == nil {
+		err = write(b, "doc", dfslib.WRITE, map[uint32]string{2: "other 2"})
+	}
+	check("another client writes a chunk written offline", err)
+
+	// Mounting publishes the writes, the conflict waits for the app
+	a, err = dfslib.MountDFS(serverAddr, "127.0.0.1", pathA)
+	if err == nil {
+		var conflicts []dfslib.WriteConflict
+		conflicts, err = a.Reconcile()
+		if err == nil && (len(conflicts) != 1 || conflicts[0].Name != "doc" || conflicts[0].Chunk != 2 ||
+			string(conflicts[0].Data[:len("offline 2")]) != "offline 2") {
+			err = fmt.Errorf("got conflicts %+v", conflicts)
+		}
+	}
+	check("Reconcile returns the conflicting write", err)
+	conflicts, err := a.Reconcile()
+	if err == nil && len(conflicts) > 0 {
+		err = fmt.Errorf("got conflicts %+v", conflicts)
+	}
+	check("a conflict is only returned once", err)
+	check("other clients read the published write and their own",
+		read(b, "doc", dfslib.READ, map[uint32]string{0: "first 0", 1: "offline 1", 2: "other 2"}))
+
+	// Writes dropped before they are published
+	check("write in DWRITE mode while connected", write(a, "doc", dfslib.DWRITE, map[uint32]string{0: "dropped 0"}))
+	check("DiscardWrites", a.DiscardWrites("doc"))
+	conflicts, err = a.Reconcile()
+	if err == nil && len(conflicts) > 0 {
+		err = fmt.Errorf("got conflicts %+v", conflicts)
+	}
+	if err == nil {
+		err = read(b, "doc", dfslib.READ, map[uint32]string{0: "first 0"})
+	}
+	check("discarded writes are not published", err)
+
+	a.UMountDFS()
+	b.UMountDFS()
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,254 @@
+/*
+ * Test of a primary server failing over to its backup. The servers run as
+ * child processes of this program so they can be stopped and killed:
+ *
+ * $ go run -race failover_app.go [server binary] [first port]
+ *
+ * Without a server binary, server.go is built into a temporary directory.
+ * - Writes made through the primary are copied to the backup
+ * - The primary refuses writes while its backup is stopped and can't renew
+ *   its lease, and serves them again once the backup follows
+ * - Once the primary is killed, clients move to the backup, which has every
+ *   write, and keep writing there
+ * - The old primary started again stays fenced, since the backup took over
+ */
+
+package main
+
+import (
+	"./dfslib"
+
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// How long the primary keeps serving after its backup stops following, as in server.go
+const primaryLease = 3 * time.Second
+
+// Starts a server process, its output goes to a log file next to its data directory
+func startServer(binary string, dir string, args ...string) (*exec.Cmd, error) {
+	logFile, err := os.Create(filepath.Join(dir, fmt.Sprintf("server-%s.log", args[0])))
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(binary, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	return cmd, cmd.Start()
+}
+
+// Kills a server process and waits for it to exit
+func stop(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+}
+
+// Waits for a server to take clients at addr
+func waitListening(addr string) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("server at %s did not start", addr)
+}
+
+// Returns chunk holding content
+func chunkOf(content string) *dfslib.Chunk {
+	var chunk dfslib.Chunk
+	copy(chunk[:], content)
+	return &chunk
+}
+
+// Opens fname for writing and writes content to chunk 0
+func write(dfs dfslib.DFS, fname string, content string) error {
+	f, err := dfs.Open(fname, dfslib.WRITE)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Write(0, chunkOf(content))
+}
+
+// Retries write until it succeeds or timeout passes
+func writeWithin(timeout time.Duration, dfs dfslib.DFS, fname string, content string) (err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		err = write(dfs, fname, content)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// Opens fname for reading and checks chunk 0 holds content
+func read(dfs dfslib.DFS, fname string, content string) error {
+	f, err := dfs.Open(fname, dfslib.READ)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var chunk dfslib.Chunk
+	err = f.Read(0, &chunk)
+	if err != nil {
+		return err
+	}
+	if chunk != *chunkOf(content) {
+		return fmt.Errorf("%s holds %q, expected %q", fname, string(chunk[:len(content)]), content)
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 3 {
+		fmt.Println("Usage: go run -race failover_app.go [server binary] [first port]")
+		return
+	}
+	dir, err := ioutil.TempDir("", "failover")
+	if err != nil {
+		panic("Could not create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+
+	binary := filepath.Join(dir, "server")
+	if len(os.Args) > 1 {
+		binary = os.Args[1]
+	} else {
+		build := exec.Command("go", "build", "-race", "-o", binary, "server.go")
+		build.Env = append(os.Environ(), "GO111MODULE=off")
+		if out, err := build.CombinedOutput(); err != nil {
+			fmt.Printf("Error: Could not build server.go: %v\n%s", err, out)
+			os.Exit(1)
+		}
+	}
+	port := 9420
+	if len(os.Args) > 2 {
+		port, _ = strconv.Atoi(os.Args[2])
+	}
+	primaryAddr := fmt.Sprintf("127.0.0.1:%d", port)
+	backupAddr := fmt.Sprintf("127.0.0.1:%d", port+1)
+	servers := primaryAddr + "," + backupAddr
+
+	primary, err := startServer(binary, dir, primaryAddr, filepath.Join(dir, "primary"))
+	if err == nil {
+		err = waitListening(primaryAddr)
+	}
+	if err != nil {
+		fmt.Println("Error: Could not start the primary:", err)
+		os.Exit(1)
+	}
+	backup, err := startServer(binary, dir, backupAddr, filepath.Join(dir, "backup"), primaryAddr)
+	if err != nil {
+		stop(primary)
+		fmt.Println("Error: Could not start the backup:", err)
+		os.Exit(1)
+	}
+	// Give the backup time to register with the primary, it only takes clients once it takes over
+	time.Sleep(time.Second)
+
+	failed := false
+	check := func(description string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("ERROR %s: %v\n", description, err)
+		} else {
+			fmt.Printf("OK %s\n", description)
+		}
+	}
+
+	mount := func(addr string, name string) (dfslib.DFS, error) {
+		localPath := filepath.Join(dir, name)
+		os.Mkdir(localPath, 0755)
+		return dfslib.MountDFS(addr, "127.0.0.1", localPath)
+	}
+
+	writer, err := mount(servers, "writer")
+	check("mount through the primary", err)
+	if err != nil {
+		stop(backup)
+		stop(primary)
+		os.Exit(1)
+	}
+	for i := 0; i < 5; i++ {
+		err = write(writer, "file"+strconv.Itoa(i), "before "+strconv.Itoa(i))
+		if err != nil {
+			break
+		}
+	}
+	check("write through the primary", err)
+
+	// The backup can't renew the primary's lease while it is stopped
+	backup.Process.Signal(syscall.SIGSTOP)
+	time.Sleep(primaryLease + time.Second)
+	err = write(writer, "file0", "fenced")
+	if err == nil {
+		err = fmt.Errorf("write succeeded")
+	} else {
+		err = nil
+	}
+	check("primary refuses writes while its backup is stopped", err)
+	backup.Process.Signal(syscall.SIGCONT)
+	check("primary serves writes once its backup follows again",
+		writeWithin(20*time.Second, writer, "file0", "before 0"))
+
+	stop(primary)
+	check("writes go to the backup after the primary is killed",
+		writeWithin(20*time.Second, writer, "file1", "after 1"))
+
+	reader, err := mount(servers, "reader")
+	if err == nil {
+		for i := 0; i < 5; i++ {
+			content := "before " + strconv.Itoa(i)
+			if i == 1 {
+				content = "after 1"
+			}
+			err = read(reader, "file"+strconv.Itoa(i), content)
+			if err != nil {
+				break
+			}
+		}
+	}
+	check("backup has every write", err)
+
+	// The old primary must not take writes the backup doesn't see
+	primary, err = startServer(binary, dir, primaryAddr, filepath.Join(dir, "primary"))
+	if err == nil {
+		err = waitListening(primaryAddr)
+	}
+	if err == nil {
+		var stale dfslib.DFS
+		stale, err = mount(primaryAddr, "stale")
+		if err == nil {
+			if write(stale, "file2", "stale") == nil {
+				err = fmt.Errorf("write succeeded")
+			}
+			stale.UMountDFS()
+		} else {
+			err = nil
+		}
+	}
+	check("old primary started again stays fenced", err)
+	check("backup still has the latest writes", read(reader, "file2", "before 2"))
+
+	writer.UMountDFS()
+	reader.UMountDFS()
+	stop(backup)
+	stop(primary)
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+
+Byte-oriented access to DFS files. FileIO wraps a DFSFile so that it
+can be used with the standard io interfaces (bufio, io.Copy,
+encoding/json, ...) instead of indexing Chunk values by hand.
+
+*/
+
+package dfslib
+
+import (
+	"errors"
+	"io"
+)
+
+// Implemented by files that know their own length
+type sizer interface {
+	size() (int64, error)
+}
+
+// FileIO implements io.ReaderAt, io.WriterAt, io.ReadWriteSeeker and
+// io.Closer on top of a DFSFile. Errors from the underlying file
+// (DisconnectedError, ChunkUnavailableError, BadFileModeError, ...)
+// are returned unchanged.
+type FileIO struct {
+	File   DFSFile // File being adapted
+	Offset int64   // Offset used by Read, Write and Seek
+}
+
+// Returns a FileIO positioned at the start of f
+func NewFileIO(f DFSFile) *FileIO {
+	return &FileIO{File: f}
+}
+
+// Returns the number of bytes in the file
+func (fio *FileIO) size() (int64, error) {
+	if f, ok := fio.File.(sizer); ok {
+		return f.size()
+	}
+	return 0, errors.New("DFS: file size unknown")
+}
+
+// Reads len(p) bytes starting at byte offset off
+// Returns io.EOF if the end of the file is reached before p is filled
+func (fio *FileIO) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("DFS: negative offset")
+	}
+
+	// Without a known size read exactly what was asked for
+	end := off + int64(len(p))
+	size, err := fio.size()
+	if err == nil && size < end {
+		end = size
+	}
+	if off >= end && len(p) > 0 {
+		return 0, io.EOF
+	}
+
+	chunkSize := int64(fio.File.ChunkSize())
+	chunk := make([]byte, chunkSize)
+	for off+int64(n) < end {
+		pos := off + int64(n)
+		chunkNum := pos / chunkSize
+		start := pos % chunkSize
+
+		err = fio.File.ReadChunk(uint32(chunkNum), chunk)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:end-off], chunk[start:])
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Writes len(p) bytes starting at byte offset off
+// Chunks that are only partly covered by p are read, modified and written back
+func (fio *FileIO) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("DFS: negative offset")
+	}
+
+	chunkSize := int64(fio.File.ChunkSize())
+	chunk := make([]byte, chunkSize)
+	for n < len(p) {
+		pos := off + int64(n)
+		chunkNum := pos / chunkSize
+		start := pos % chunkSize
+
+		if start != 0 || int64(len(p)-n) < chunkSize {
+			err = fio.File.ReadChunk(uint32(chunkNum), chunk)
+			if err != nil {
+				return n, err
+			}
+		}
+		written := copy(chunk[start:], p[n:])
+		err = fio.File.WriteChunk(uint32(chunkNum), chunk)
+		if err != nil {
+			return n, err
+		}
+		n += written
+	}
+	return n, nil
+}
+
+// Reads from the current offset and advances it
+func (fio *FileIO) Read(p []byte) (n int, err error) {
+	n, err = fio.ReadAt(p, fio.Offset)
+	fio.Offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Writes at the current offset and advances it
+func (fio *FileIO) Write(p []byte) (n int, err error) {
+	n, err = fio.WriteAt(p, fio.Offset)
+	fio.Offset += int64(n)
+	return n, err
+}
+
+// Sets the offset for the next Read or Write
+func (fio *FileIO) Seek(offset int64, whence int) (int64, error) {
+	var base int64
+	switch whence {
+	case io.SeekStart:
+		base = 0
+	case io.SeekCurrent:
+		base = fio.Offset
+	case io.SeekEnd:
+		size, err := fio.size()
+		if err != nil {
+			return fio.Offset, err
+		}
+		base = size
+	default:
+		return fio.Offset, errors.New("DFS: invalid whence")
+	}
+	if base+offset < 0 {
+		return fio.Offset, errors.New("DFS: negative offset")
+	}
+	fio.Offset = base + offset
+	return fio.Offset, nil
+}
+
+// Closes the underlying file
+func (fio *FileIO) Close() error {
+	return fio.File.Close()
+}
@@ -0,0 +1,952 @@
+/*
+
+Raft consensus used to replicate the server's metadata log across a group of
+servers. A record proposed on the leader is committed once a majority of the
+group has it on disk, so any minority of the group can fail without losing it.
+
+Each node serves the other members on its own address, so several nodes can run
+in one process.
+
+*/
+
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// How often the leader sends entries or heartbeats to each member
+	heartbeatInterval = 100 * time.Millisecond
+
+	// A member that hears nothing from a leader for a random time between
+	// electionTimeout and twice that starts an election
+	electionTimeout = 500 * time.Millisecond
+
+	// How long a call to another member may take
+	callTimeout = 200 * time.Millisecond
+
+	// Most entries sent in one AppendEntries call
+	maxEntries = 256
+
+	// Files in the node's directory
+	stateFile    = "raft-state.json"
+	snapshotFile = "raft-snapshot.json"
+	logFile      = "raft.log"
+)
+
+var (
+	// Returned when a proposal is made to a member that isn't the leader
+	ErrNotLeader = errors.New("raft: not the leader")
+
+	// Returned when a proposal was not committed in time, it may still be committed later
+	ErrTimeout = errors.New("raft: proposal not committed in time")
+)
+
+// Entry of the replicated log, Data is nil for the entry a new leader starts its term with
+type Entry struct {
+	Index int
+	Term  int
+	Data  []byte
+}
+
+// Committed entry or snapshot handed to the state machine, in log order
+// A snapshot replaces the whole state, its Data is nil if nothing was ever snapshotted
+type ApplyMsg struct {
+	Index    int
+	Term     int
+	Data     []byte
+	Snapshot bool
+}
+
+// Saved term and vote, both must survive a restart
+type persistentState struct {
+	Term     int
+	VotedFor string
+}
+
+// Saved snapshot of the state machine up to Index
+type savedSnapshot struct {
+	Index int
+	Term  int
+	Data  []byte
+}
+
+func init() {
+	// Members must not pick the same election timeouts
+	rand.Seed(time.Now().UnixNano())
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// Member of a raft group
+type Raft struct {
+	me    string                 // Address the member serves the group at
+	peers []string               // Addresses of the other members
+	conns map[string]*rpc.Client // Connections to the other members, nil until dialled
+	apply func(ApplyMsg)         // Called with each committed entry in order
+
+	dir      string       // Where state, snapshot and log are saved
+	log      []Entry      // log[0] holds the index and term the snapshot ends at
+	snapshot []byte       // State machine at log[0].Index
+	logOut   *os.File     // Entries after the snapshot, one JSON entry per line
+	listener net.Listener // Where the other members call this one
+	accepted []net.Conn   // Connections accepted by listener
+
+	term        int
+	votedFor    string
+	role        role
+	leaderAddr  string
+	commitIndex int
+	lastApplied int
+	restore     bool                 // The state machine must be replaced with the snapshot
+	nextIndex   map[string]int       // Next entry to send to each member
+	matchIndex  map[string]int       // Last entry each member is known to have
+	lastAck     map[string]time.Time // When each member last answered this leader
+	deadline    time.Time            // When to start an election
+
+	dead    bool
+	mutex   sync.Mutex
+	changed *sync.Cond // Broadcast when commitIndex, the role or the snapshot changes
+}
+
+// Starts a member serving the group at me with the other members at peers
+// State saved in dir is loaded, so a member can be stopped with Kill and started again
+// apply is called from one goroutine with every committed entry, beginning with the snapshot
+func Start(me string, peers []string, dir string, apply func(ApplyMsg)) (*Raft, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	rf := &Raft{
+		me:      me,
+		peers:   peers,
+		conns:   make(map[string]*rpc.Client),
+		apply:   apply,
+		dir:     dir,
+		log:     []Entry{{}},
+		restore: true,
+		lastAck: make(map[string]time.Time),
+	}
+	rf.changed = sync.NewCond(&rf.mutex)
+	err = rf.load()
+	if err != nil {
+		return nil, err
+	}
+	rf.commitIndex = rf.log[0].Index
+	rf.lastApplied = rf.log[0].Index
+	rf.resetDeadline()
+
+	server := rpc.NewServer()
+	server.RegisterName("Raft", &service{rf})
+	rf.listener, err = net.Listen("tcp", me)
+	if err != nil {
+		rf.logOut.Close()
+		return nil, err
+	}
+
+	go rf.serve(server)
+	go rf.run()
+	go rf.applyCommitted()
+	return rf, nil
+}
+
+// Stops the member, closing its connections and files
+func (rf *Raft) Kill() {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.dead {
+		return
+	}
+	rf.dead = true
+	rf.listener.Close()
+	for _, conn := range rf.accepted {
+		conn.Close()
+	}
+	for _, conn := range rf.conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	rf.logOut.Close()
+	rf.changed.Broadcast()
+}
+
+// Returns the current term and whether this member is its leader
+func (rf *Raft) State() (term int, isLeader bool) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	return rf.term, rf.role == leader
+}
+
+// Returns true if this member is still the leader of term
+func (rf *Raft) Leading(term int) bool {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	return rf.role == leader && rf.term == term && !rf.dead
+}
+
+// Returns the address of the member believed to be leader, "" if unknown
+func (rf *Raft) Leader() string {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	return rf.leaderAddr
+}
+
+// Appends data to the log if this member is the leader
+// Returns the index and term the entry is committed at if it ever is
+func (rf *Raft) Propose(data []byte) (index int, term int, err error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if rf.role != leader || rf.dead {
+		return 0, 0, ErrNotLeader
+	}
+	entry := Entry{Index: rf.lastIndex() + 1, Term: rf.term, Data: data}
+	err = rf.append([]Entry{entry})
+	if err != nil {
+		return 0, 0, err
+	}
+	rf.matchIndex[rf.me] = entry.Index
+	rf.advanceCommit()
+	for _, peer := range rf.peers {
+		rf.sendEntries(peer)
+	}
+	return entry.Index, entry.Term, nil
+}
+
+// Waits until the entry proposed at index in term is committed
+// Returns ErrNotLeader if leadership was lost first and ErrTimeout if timeout passes first
+func (rf *Raft) WaitCommitted(index int, term int, timeout time.Duration) error {
+	timer := time.AfterFunc(timeout, func() {
+		rf.mutex.Lock()
+		rf.changed.Broadcast()
+		rf.mutex.Unlock()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(timeout)
+
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	for {
+		if rf.commitIndex >= index {
+			if index > rf.log[0].Index && rf.entry(index).Term != term {
+				// Replaced by another leader's entry
+				return ErrNotLeader
+			}
+			return nil
+		}
+		if rf.role != leader || rf.term != term || rf.dead {
+			return ErrNotLeader
+		}
+		if !time.Now().Before(deadline) {
+			return ErrTimeout
+		}
+		rf.changed.Wait()
+	}
+}
+
+// Discards log entries up to index, the state machine state after applying them is state
+func (rf *Raft) Snapshot(index int, state []byte) error {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if index <= rf.log[0].Index || index > rf.lastApplied {
+		return nil
+	}
+	rf.log = append([]Entry{{Index: index, Term: rf.entry(index).Term}}, rf.log[index-rf.log[0].Index+1:]...)
+	rf.snapshot = state
+	return rf.saveSnapshot()
+}
+
+// Hands the snapshot and every committed entry to apply again, in order
+// Used by a state machine that changed ahead of the log and must be rebuilt
+func (rf *Raft) Reapply() {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	rf.restore = true
+	rf.lastApplied = rf.log[0].Index
+	rf.changed.Broadcast()
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <LOG>
+
+// Returns the index of the last entry in the log
+func (rf *Raft) lastIndex() int {
+	return rf.log[len(rf.log)-1].Index
+}
+
+// Returns the entry at index, which must be in the log or be the snapshot's last
+func (rf *Raft) entry(index int) Entry {
+	return rf.log[index-rf.log[0].Index]
+}
+
+// Appends entries to the log and its file
+func (rf *Raft) append(entries []Entry) error {
+	rf.log = append(rf.log, entries...)
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		_, err = rf.logOut.Write(append(data, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+	return rf.logOut.Sync()
+}
+
+// Drops entries from index on, which a new leader replaced
+func (rf *Raft) truncate(index int) error {
+	rf.log = rf.log[:index-rf.log[0].Index]
+	return rf.rewriteLog()
+}
+
+// Writes the log file again with the entries after the snapshot
+func (rf *Raft) rewriteLog() error {
+	var data []byte
+	for _, entry := range rf.log[1:] {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	err := writeFile(filepath.Join(rf.dir, logFile), data)
+	if err != nil {
+		return err
+	}
+	if rf.logOut != nil {
+		rf.logOut.Close()
+	}
+	rf.logOut, err = os.OpenFile(filepath.Join(rf.dir, logFile), os.O_WRONLY|os.O_APPEND, 0644)
+	return err
+}
+
+// Saves the term and vote, must be done before answering a call that changed them
+func (rf *Raft) saveState() error {
+	data, err := json.Marshal(persistentState{Term: rf.term, VotedFor: rf.votedFor})
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(rf.dir, stateFile), data)
+}
+
+// Saves the snapshot and the entries after it
+func (rf *Raft) saveSnapshot() error {
+	data, err := json.Marshal(savedSnapshot{Index: rf.log[0].Index, Term: rf.log[0].Term, Data: rf.snapshot})
+	if err != nil {
+		return err
+	}
+	err = writeFile(filepath.Join(rf.dir, snapshotFile), data)
+	if err != nil {
+		return err
+	}
+	return rf.rewriteLog()
+}
+
+// Loads the term, vote, snapshot and log saved in dir
+func (rf *Raft) load() error {
+	data, err := ioutil.ReadFile(filepath.Join(rf.dir, stateFile))
+	if err == nil {
+		var state persistentState
+		err = json.Unmarshal(data, &state)
+		if err != nil {
+			return err
+		}
+		rf.term = state.Term
+		rf.votedFor = state.VotedFor
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	data, err = ioutil.ReadFile(filepath.Join(rf.dir, snapshotFile))
+	if err == nil {
+		var snapshot savedSnapshot
+		err = json.Unmarshal(data, &snapshot)
+		if err != nil {
+			return err
+		}
+		rf.log[0] = Entry{Index: snapshot.Index, Term: snapshot.Term}
+		rf.snapshot = snapshot.Data
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	in, err := os.Open(filepath.Join(rf.dir, logFile))
+	if err == nil {
+		decoder := json.NewDecoder(in)
+		for {
+			var entry Entry
+			// Stop at the end of the log or at an entry cut short by a crash
+			if decoder.Decode(&entry) != nil {
+				break
+			}
+			// Entries already in the snapshot are left from a crash before the log was rewritten
+			if entry.Index == rf.lastIndex()+1 {
+				rf.log = append(rf.log, entry)
+			}
+		}
+		in.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Start from a clean file in case the last entry was cut short
+	return rf.rewriteLog()
+}
+
+// Writes data to a temporary file and renames it over name so a crash never leaves part of it
+func writeFile(name string, data []byte) error {
+	tmp, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(name+".tmp", name)
+	if err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(name)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// </LOG>
+////////////////////////////////////////////////////////////////////////////////////////////
+// <ELECTIONS AND REPLICATION>
+
+// Picks a new random time to start an election at
+func (rf *Raft) resetDeadline() {
+	rf.deadline = time.Now().Add(electionTimeout + time.Duration(rand.Int63n(int64(electionTimeout))))
+}
+
+// Becomes a follower in term, forgetting the vote if the term is new
+func (rf *Raft) becomeFollower(term int) {
+	if term > rf.term {
+		rf.term = term
+		rf.votedFor = ""
+		rf.saveState()
+	}
+	if rf.role == leader {
+		rf.leaderAddr = ""
+		rf.resetDeadline()
+	}
+	rf.role = follower
+	rf.changed.Broadcast()
+}
+
+// Returns true if count members out of the whole group are a majority
+func (rf *Raft) majority(count int) bool {
+	return count > (len(rf.peers)+1)/2
+}
+
+// Starts elections when no leader is heard from and sends heartbeats while leading
+func (rf *Raft) run() {
+	for {
+		time.Sleep(heartbeatInterval / 5)
+		rf.mutex.Lock()
+		if rf.dead {
+			rf.mutex.Unlock()
+			return
+		}
+		now := time.Now()
+		if rf.role == leader {
+			// Step down if a majority stopped answering, a new leader may be elected without us
+			answered := 1
+			for _, peer := range rf.peers {
+				if now.Sub(rf.lastAck[peer]) < electionTimeout {
+					answered++
+				}
+			}
+			if !rf.majority(answered) {
+				rf.becomeFollower(rf.term)
+			} else if now.After(rf.deadline) {
+				for _, peer := range rf.peers {
+					rf.sendEntries(peer)
+				}
+				rf.deadline = now.Add(heartbeatInterval)
+			}
+		} else if now.After(rf.deadline) {
+			rf.startElection()
+		}
+		rf.mutex.Unlock()
+	}
+}
+
+// Votes for itself in a new term and asks the other members for their votes
+func (rf *Raft) startElection() {
+	rf.term++
+	rf.role = candidate
+	rf.votedFor = rf.me
+	rf.leaderAddr = ""
+	rf.saveState()
+	rf.resetDeadline()
+
+	args := &RequestVoteArgs{
+		Term:         rf.term,
+		Candidate:    rf.me,
+		LastLogIndex: rf.lastIndex(),
+		LastLogTerm:  rf.log[len(rf.log)-1].Term,
+	}
+	votes := 1
+	if rf.majority(votes) {
+		rf.becomeLeader()
+		return
+	}
+	for _, peer := range rf.peers {
+		go func(peer string) {
+			var reply RequestVoteReply
+			if !rf.call(peer, "Raft.RequestVote", args, &reply) {
+				return
+			}
+			rf.mutex.Lock()
+			defer rf.mutex.Unlock()
+			if reply.Term > rf.term {
+				rf.becomeFollower(reply.Term)
+				return
+			}
+			if !reply.Granted || rf.role != candidate || rf.term != args.Term {
+				return
+			}
+			votes++
+			if rf.majority(votes) {
+				rf.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// Takes over as leader and starts the term with an empty entry
+// Committing it commits every entry before it, so the state machine knows it is caught up
+// once the entry is applied
+func (rf *Raft) becomeLeader() {
+	rf.role = leader
+	rf.leaderAddr = rf.me
+	rf.nextIndex = make(map[string]int)
+	rf.matchIndex = make(map[string]int)
+	now := time.Now()
+	for _, peer := range rf.peers {
+		rf.nextIndex[peer] = rf.lastIndex() + 1
+		rf.matchIndex[peer] = 0
+		rf.lastAck[peer] = now
+	}
+	entry := Entry{Index: rf.lastIndex() + 1, Term: rf.term}
+	rf.append([]Entry{entry})
+	rf.matchIndex[rf.me] = entry.Index
+	rf.advanceCommit()
+	for _, peer := range rf.peers {
+		rf.sendEntries(peer)
+	}
+	rf.deadline = now.Add(heartbeatInterval)
+	rf.changed.Broadcast()
+}
+
+// Sends peer the entries it is missing, or the snapshot if they were discarded
+func (rf *Raft) sendEntries(peer string) {
+	next := rf.nextIndex[peer]
+	if next <= rf.log[0].Index {
+		rf.sendSnapshot(peer)
+		return
+	}
+	entries := rf.log[next-rf.log[0].Index:]
+	if len(entries) > maxEntries {
+		entries = entries[:maxEntries]
+	}
+	args := &AppendEntriesArgs{
+		Term:         rf.term,
+		Leader:       rf.me,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  rf.entry(next - 1).Term,
+		Entries:      append([]Entry(nil), entries...),
+		LeaderCommit: rf.commitIndex,
+	}
+	go func() {
+		var reply AppendEntriesReply
+		if !rf.call(peer, "Raft.AppendEntries", args, &reply) {
+			return
+		}
+		rf.mutex.Lock()
+		defer rf.mutex.Unlock()
+		if reply.Term > rf.term {
+			rf.becomeFollower(reply.Term)
+			return
+		}
+		if rf.role != leader || rf.term != args.Term {
+			return
+		}
+		rf.lastAck[peer] = time.Now()
+		if !reply.Success {
+			// Skip back past the entries that don't match and try again
+			if reply.ConflictIndex < rf.nextIndex[peer] {
+				rf.nextIndex[peer] = reply.ConflictIndex
+				if rf.nextIndex[peer] < 1 {
+					rf.nextIndex[peer] = 1
+				}
+				rf.sendEntries(peer)
+			}
+			return
+		}
+		match := args.PrevLogIndex + len(args.Entries)
+		if match > rf.matchIndex[peer] {
+			rf.matchIndex[peer] = match
+			rf.nextIndex[peer] = match + 1
+			rf.advanceCommit()
+		}
+		if rf.nextIndex[peer] <= rf.lastIndex() {
+			rf.sendEntries(peer)
+		}
+	}()
+}
+
+// Sends peer the snapshot, it lags behind the entries still in the log
+func (rf *Raft) sendSnapshot(peer string) {
+	args := &InstallSnapshotArgs{
+		Term:      rf.term,
+		Leader:    rf.me,
+		LastIndex: rf.log[0].Index,
+		LastTerm:  rf.log[0].Term,
+		Data:      rf.snapshot,
+	}
+	go func() {
+		var reply InstallSnapshotReply
+		if !rf.call(peer, "Raft.InstallSnapshot", args, &reply) {
+			return
+		}
+		rf.mutex.Lock()
+		defer rf.mutex.Unlock()
+		if reply.Term > rf.term {
+			rf.becomeFollower(reply.Term)
+			return
+		}
+		if rf.role != leader || rf.term != args.Term {
+			return
+		}
+		rf.lastAck[peer] = time.Now()
+		if args.LastIndex > rf.matchIndex[peer] {
+			rf.matchIndex[peer] = args.LastIndex
+			rf.nextIndex[peer] = args.LastIndex + 1
+		}
+	}()
+}
+
+// Commits the last entry of this term a majority has, with every entry before it
+// Entries of earlier terms are only committed this way, see section 5.4.2 of the raft paper
+func (rf *Raft) advanceCommit() {
+	for index := rf.lastIndex(); index > rf.commitIndex; index-- {
+		if rf.entry(index).Term != rf.term {
+			return
+		}
+		count := 0
+		for _, match := range rf.matchIndex {
+			if match >= index {
+				count++
+			}
+		}
+		if rf.majority(count) {
+			rf.commitIndex = index
+			rf.changed.Broadcast()
+			return
+		}
+	}
+}
+
+// Hands committed entries to apply in order
+func (rf *Raft) applyCommitted() {
+	rf.mutex.Lock()
+	for {
+		for !rf.dead && !rf.restore && rf.lastApplied >= rf.commitIndex {
+			rf.changed.Wait()
+		}
+		if rf.dead {
+			rf.mutex.Unlock()
+			return
+		}
+		var msg ApplyMsg
+		if rf.restore || rf.lastApplied < rf.log[0].Index {
+			msg = ApplyMsg{Index: rf.log[0].Index, Term: rf.log[0].Term, Data: rf.snapshot, Snapshot: true}
+			rf.restore = false
+		} else {
+			entry := rf.entry(rf.lastApplied + 1)
+			msg = ApplyMsg{Index: entry.Index, Term: entry.Term, Data: entry.Data}
+		}
+		rf.lastApplied = msg.Index
+		rf.mutex.Unlock()
+		rf.apply(msg)
+		rf.mutex.Lock()
+	}
+}
+
+// Calls method on peer, returns false if the call failed or took longer than callTimeout
+func (rf *Raft) call(peer string, method string, args interface{}, reply interface{}) bool {
+	rf.mutex.Lock()
+	if rf.dead {
+		rf.mutex.Unlock()
+		return false
+	}
+	conn := rf.conns[peer]
+	rf.mutex.Unlock()
+
+	if conn == nil {
+		c, err := net.DialTimeout("tcp", peer, callTimeout)
+		if err != nil {
+			return false
+		}
+		rf.mutex.Lock()
+		if rf.dead || rf.conns[peer] != nil {
+			// Killed or another call connected first
+			c.Close()
+			conn = rf.conns[peer]
+		} else {
+			conn = rpc.NewClient(c)
+			rf.conns[peer] = conn
+		}
+		rf.mutex.Unlock()
+		if conn == nil {
+			return false
+		}
+	}
+
+	c := conn.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-c.Done:
+		if c.Error == rpc.ErrShutdown {
+			// Connect again on the next call
+			rf.mutex.Lock()
+			if rf.conns[peer] == conn {
+				delete(rf.conns, peer)
+			}
+			rf.mutex.Unlock()
+			conn.Close()
+		}
+		return c.Error == nil
+	case <-time.After(callTimeout):
+		return false
+	}
+}
+
+// Serves calls from the other members until the member is killed
+func (rf *Raft) serve(server *rpc.Server) {
+	for {
+		conn, err := rf.listener.Accept()
+		if err != nil {
+			rf.mutex.Lock()
+			dead := rf.dead
+			rf.mutex.Unlock()
+			if dead {
+				return
+			}
+			continue
+		}
+		rf.mutex.Lock()
+		if rf.dead {
+			conn.Close()
+		} else {
+			rf.accepted = append(rf.accepted, conn)
+		}
+		rf.mutex.Unlock()
+		go server.ServeConn(conn)
+	}
+}
+
+// </ELECTIONS AND REPLICATION>
+////////////////////////////////////////////////////////////////////////////////////////////
+// <RPC>
+
+type RequestVoteArgs struct {
+	Term         int
+	Candidate    string
+	LastLogIndex int
+	LastLogTerm  int
+}
+
+type RequestVoteReply struct {
+	Term    int
+	Granted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         int
+	Leader       string
+	PrevLogIndex int
+	PrevLogTerm  int
+	Entries      []Entry
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Term          int
+	Success       bool
+	ConflictIndex int // First index to send again when Success is false
+}
+
+type InstallSnapshotArgs struct {
+	Term      int
+	Leader    string
+	LastIndex int
+	LastTerm  int
+	Data      []byte
+}
+
+type InstallSnapshotReply struct {
+	Term int
+}
+
+// Calls from the other members, kept apart from Raft so only these are rpc methods
+type service struct {
+	rf *Raft
+}
+
+// Votes for the candidate if this member hasn't voted for another in the term
+// and the candidate's log is at least as up to date as its own
+func (s *service) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	rf := s.rf
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if args.Term > rf.term {
+		rf.becomeFollower(args.Term)
+	}
+	reply.Term = rf.term
+	if args.Term < rf.term {
+		return nil
+	}
+
+	lastTerm := rf.log[len(rf.log)-1].Term
+	upToDate := args.LastLogTerm > lastTerm ||
+		(args.LastLogTerm == lastTerm && args.LastLogIndex >= rf.lastIndex())
+	if (rf.votedFor == "" || rf.votedFor == args.Candidate) && upToDate {
+		rf.votedFor = args.Candidate
+		err := rf.saveState()
+		if err != nil {
+			return err
+		}
+		rf.resetDeadline()
+		reply.Granted = true
+	}
+	return nil
+}
+
+// Appends the leader's entries after checking the log matches the leader's before them
+func (s *service) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	rf := s.rf
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if args.Term > rf.term || (args.Term == rf.term && rf.role != follower) {
+		rf.becomeFollower(args.Term)
+	}
+	reply.Term = rf.term
+	if args.Term < rf.term {
+		return nil
+	}
+	rf.leaderAddr = args.Leader
+	rf.resetDeadline()
+
+	first := rf.log[0].Index
+	if args.PrevLogIndex > rf.lastIndex() {
+		reply.ConflictIndex = rf.lastIndex() + 1
+		return nil
+	}
+	if args.PrevLogIndex > first && rf.entry(args.PrevLogIndex).Term != args.PrevLogTerm {
+		// Ask for the whole conflicting term again
+		term := rf.entry(args.PrevLogIndex).Term
+		index := args.PrevLogIndex
+		for index > first+1 && rf.entry(index-1).Term == term {
+			index--
+		}
+		reply.ConflictIndex = index
+		return nil
+	}
+
+	for i, entry := range args.Entries {
+		if entry.Index <= first {
+			// Already in the snapshot
+			continue
+		}
+		if entry.Index <= rf.lastIndex() {
+			if rf.entry(entry.Index).Term == entry.Term {
+				continue
+			}
+			err := rf.truncate(entry.Index)
+			if err != nil {
+				return err
+			}
+		}
+		err := rf.append(args.Entries[i:])
+		if err != nil {
+			return err
+		}
+		break
+	}
+	reply.Success = true
+
+	last := args.PrevLogIndex + len(args.Entries)
+	if args.LeaderCommit > rf.commitIndex {
+		rf.commitIndex = args.LeaderCommit
+		if last < rf.commitIndex {
+			rf.commitIndex = last
+		}
+		rf.changed.Broadcast()
+	}
+	return nil
+}
+
+// Replaces the log with the leader's snapshot, keeping entries after it that match
+func (s *service) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	rf := s.rf
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if args.Term > rf.term || (args.Term == rf.term && rf.role != follower) {
+		rf.becomeFollower(args.Term)
+	}
+	reply.Term = rf.term
+	if args.Term < rf.term {
+		return nil
+	}
+	rf.leaderAddr = args.Leader
+	rf.resetDeadline()
+	if args.LastIndex <= rf.log[0].Index {
+		return nil
+	}
+
+	if args.LastIndex <= rf.lastIndex() && rf.entry(args.LastIndex).Term == args.LastTerm {
+		rf.log = append([]Entry{{Index: args.LastIndex, Term: args.LastTerm}}, rf.log[args.LastIndex-rf.log[0].Index+1:]...)
+	} else {
+		rf.log = []Entry{{Index: args.LastIndex, Term: args.LastTerm}}
+	}
+	rf.snapshot = args.Data
+	if args.LastIndex > rf.commitIndex {
+		rf.commitIndex = args.LastIndex
+	}
+	if args.LastIndex > rf.lastApplied {
+		rf.restore = true
+	}
+	rf.changed.Broadcast()
+	return rf.saveSnapshot()
+}
+
+// </RPC>
+////////////////////////////////////////////////////////////////////////////////////////////
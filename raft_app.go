@@ -0,0 +1,249 @@
+/*
+ * Test of the raft group the servers replicate metadata with. All members run
+ * in this process on localhost, so members can be killed and started again:
+ *
+ * $ go run -race raft_app.go [members] [first port]
+ *
+ * - Records proposed on the leader are committed and applied by every member
+ * - Killing the leader and another member elects a new leader that keeps
+ *   every committed record and commits new ones
+ * - Members started again catch up, through snapshots when the leader has
+ *   discarded the records they are missing
+ * - Every member applies the same records in the same order
+ */
+
+package main
+
+import (
+	"./raft"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Records applied between snapshots of a member's state
+const snapshotEvery = 10
+
+// Member of the group with its state machine, the list of records applied
+type member struct {
+	addr  string
+	peers []string
+	dir   string
+
+	mutex   sync.Mutex
+	rf      *raft.Raft
+	records []string
+	applied int // Index of the last entry applied
+}
+
+// Starts the member's raft, loading what it saved before it was killed
+func (m *member) start() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	rf, err := raft.Start(m.addr, m.peers, m.dir, m.apply)
+	m.rf = rf
+	return err
+}
+
+func (m *member) kill() {
+	m.mutex.Lock()
+	rf := m.rf
+	m.mutex.Unlock()
+	rf.Kill()
+}
+
+func (m *member) apply(msg raft.ApplyMsg) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if msg.Snapshot {
+		m.records = nil
+		if msg.Data != nil {
+			json.Unmarshal(msg.Data, &m.records)
+		}
+	} else if msg.Data != nil {
+		m.records = append(m.records, string(msg.Data))
+	}
+	m.applied = msg.Index
+	if !msg.Snapshot && msg.Index%snapshotEvery == 0 && m.rf != nil {
+		data, _ := json.Marshal(m.records)
+		m.rf.Snapshot(msg.Index, data)
+	}
+}
+
+// Returns a copy of the records applied
+func (m *member) state() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string(nil), m.records...)
+}
+
+// Returns the member leading the group, waiting for an election if needed
+func leader(members []*member, alive map[int]bool) (*member, int, error) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for i, m := range members {
+			if !alive[i] {
+				continue
+			}
+			if term, isLeader := m.rf.State(); isLeader {
+				return m, term, nil
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil, 0, fmt.Errorf("no leader elected")
+}
+
+// Proposes n records on the leader and waits for each to be committed
+func propose(members []*member, alive map[int]bool, first int, n int) ([]string, error) {
+	var committed []string
+	for i := first; i < first+n; {
+		m, _, err := leader(members, alive)
+		if err != nil {
+			return committed, err
+		}
+		record := fmt.Sprintf("record %d", i)
+		index, term, err := m.rf.Propose([]byte(record))
+		if err == nil {
+			err = m.rf.WaitCommitted(index, term, 2*time.Second)
+		}
+		if err != nil {
+			// Leadership changed, propose again on the new leader
+			continue
+		}
+		committed = append(committed, record)
+		i++
+	}
+	return committed, nil
+}
+
+// Waits until every live member applied exactly the committed records, in order
+func converge(members []*member, alive map[int]bool, committed []string) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		var err error
+		for i, m := range members {
+			if !alive[i] {
+				continue
+			}
+			records := m.state()
+			if len(records) != len(committed) {
+				err = fmt.Errorf("member %d applied %d records, %d were committed", i, len(records), len(committed))
+				break
+			}
+			for j := range records {
+				if records[j] != committed[j] {
+					err = fmt.Errorf("member %d applied %q at %d, %q was committed", i, records[j], j, committed[j])
+					break
+				}
+			}
+		}
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func main() {
+	if len(os.Args) > 3 {
+		fmt.Println("Usage: go run -race raft_app.go [members] [first port]")
+		return
+	}
+	n, port := 5, 9500
+	if len(os.Args) > 1 {
+		n, _ = strconv.Atoi(os.Args[1])
+	}
+	if len(os.Args) > 2 {
+		port, _ = strconv.Atoi(os.Args[2])
+	}
+
+	dir, err := ioutil.TempDir("", "raft")
+	if err != nil {
+		panic("Could not create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("127.0.0.1:%d", port+i)
+	}
+	members := make([]*member, n)
+	alive := make(map[int]bool)
+	for i := range members {
+		var peers []string
+		for j, addr := range addrs {
+			if j != i {
+				peers = append(peers, addr)
+			}
+		}
+		members[i] = &member{addr: addrs[i], peers: peers, dir: filepath.Join(dir, strconv.Itoa(i))}
+		err = members[i].start()
+		if err != nil {
+			fmt.Println("Error: Could not start member", i, err)
+			os.Exit(1)
+		}
+		alive[i] = true
+	}
+
+	failed := false
+	check := func(description string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("ERROR %s: %v\n", description, err)
+		} else {
+			fmt.Printf("OK %s\n", description)
+		}
+	}
+
+	committed, err := propose(members, alive, 0, 25)
+	check("commit records", err)
+	check("all members apply committed records", converge(members, alive, committed))
+
+	// Kill a minority including the leader
+	lead, _, _ := leader(members, alive)
+	var killed []int
+	for i, m := range members {
+		if m == lead {
+			m.kill()
+			alive[i] = false
+			killed = append(killed, i)
+		}
+	}
+	for i, m := range members {
+		if alive[i] && len(killed) < (n-1)/2 {
+			m.kill()
+			alive[i] = false
+			killed = append(killed, i)
+		}
+	}
+	more, err := propose(members, alive, len(committed), 25)
+	committed = append(committed, more...)
+	check(fmt.Sprintf("commit records with members %v killed", killed), err)
+	check("live members keep every committed record", converge(members, alive, committed))
+
+	// The killed members missed records the others have snapshotted
+	for _, i := range killed {
+		check(fmt.Sprintf("start member %d again", i), members[i].start())
+		alive[i] = true
+	}
+	more, err = propose(members, alive, len(committed), 5)
+	committed = append(committed, more...)
+	check("commit records after restart", err)
+	check("restarted members catch up", converge(members, alive, committed))
+
+	for i, m := range members {
+		if alive[i] {
+			m.kill()
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,267 @@
+/*
+ * Test of mounts getting back to a server they lost. The server runs as a
+ * child process of this program so it can be killed and started again, and
+ * so does one of the clients so its heartbeats can be stopped:
+ *
+ * $ go run -race reconnect_app.go [server binary] [port]
+ *
+ * Without a server binary, server.go is built into a temporary directory.
+ * - While the server is down the mount is disconnected, but files can still
+ *   be read in DREAD mode
+ * - Once the server is started again the mount reconnects on its own and
+ *   writes go through
+ * - A client whose heartbeats stopped for longer than the server waits is
+ *   dropped by the server, and mounts again on its own once it resumes
+ */
+
+package main
+
+import (
+	"./dfslib"
+
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Longer than the gap in heartbeats after which the server drops a client, as in server.go
+const heartbeatGap = 6 * time.Second
+
+// Starts a server process, its output goes to a log file next to its data directory
+func startServer(binary string, dir string, args ...string) (*exec.Cmd, error) {
+	logFile, err := os.OpenFile(filepath.Join(dir, "server.log"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(binary, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	err = cmd.Start()
+	if err != nil {
+		return cmd, err
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", args[0])
+		if err == nil {
+			conn.Close()
+			return cmd, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return cmd, fmt.Errorf("server at %s did not start", args[0])
+}
+
+// Kills a process and waits for it to exit
+func stop(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+}
+
+// Returns chunk holding content
+func chunkOf(content string) *dfslib.Chunk {
+	var chunk dfslib.Chunk
+	copy(chunk[:], content)
+	return &chunk
+}
+
+// Opens fname for writing and writes content to chunk 0
+func write(dfs dfslib.DFS, fname string, content string) error {
+	f, err := dfs.Open(fname, dfslib.WRITE)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Write(0, chunkOf(content))
+}
+
+// Retries write until it succeeds or timeout passes
+func writeWithin(timeout time.Duration, dfs dfslib.DFS, fname string, content string) (err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		err = write(dfs, fname, content)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// Opens fname in mode and checks chunk 0 holds content
+func read(dfs dfslib.DFS, fname string, mode dfslib.FileMode, content string) error {
+	f, err := dfs.Open(fname, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var chunk dfslib.Chunk
+	err = f.Read(0, &chunk)
+	if err != nil {
+		return err
+	}
+	if chunk != *chunkOf(content) {
+		return fmt.Errorf("%s holds %q, expected %q", fname, string(chunk[:len(content)]), content)
+	}
+	return nil
+}
+
+// Runs as the client whose heartbeats are stopped: mounts, then for every
+// line read writes it to chunk 0 of "held" and answers OK or the error
+func runClient(serverAddr string, localPath string) {
+	dfs, err := dfslib.MountDFS(serverAddr, "127.0.0.1", localPath)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer dfs.UMountDFS()
+	lines := bufio.NewScanner(os.Stdin)
+	for lines.Scan() {
+		err = writeWithin(15*time.Second, dfs, "held", lines.Text())
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("OK")
+		}
+	}
+}
+
+// Client running in a child process
+type childClient struct {
+	cmd     *exec.Cmd
+	input   io.WriteCloser
+	answers *bufio.Scanner
+}
+
+// Has the child client write content, returns its error
+func (c *childClient) write(content string) error {
+	fmt.Fprintln(c.input, content)
+	if !c.answers.Scan() {
+		return fmt.Errorf("client exited")
+	}
+	if answer := c.answers.Text(); answer != "OK" {
+		return fmt.Errorf("%s", answer)
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) == 4 && os.Args[1] == "client" {
+		runClient(os.Args[2], os.Args[3])
+		return
+	}
+	if len(os.Args) > 3 {
+		fmt.Println("Usage: go run -race reconnect_app.go [server binary] [port]")
+		return
+	}
+	dir, err := ioutil.TempDir("", "reconnect")
+	if err != nil {
+		panic("Could not create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+
+	binary := filepath.Join(dir, "server")
+	if len(os.Args) > 1 {
+		binary = os.Args[1]
+	} else {
+		build := exec.Command("go", "build", "-race", "-o", binary, "server.go")
+		build.Env = append(os.Environ(), "GO111MODULE=off")
+		if out, err := build.CombinedOutput(); err != nil {
+			fmt.Printf("Error: Could not build server.go: %v\n%s", err, out)
+			os.Exit(1)
+		}
+	}
+	port := 9430
+	if len(os.Args) > 2 {
+		port, _ = strconv.Atoi(os.Args[2])
+	}
+	serverAddr := fmt.Sprintf("127.0.0.1:%d", port)
+	dataDir := filepath.Join(dir, "data")
+
+	server, err := startServer(binary, dir, serverAddr, dataDir)
+	if err != nil {
+		stop(server)
+		fmt.Println("Error: Could not start the server:", err)
+		os.Exit(1)
+	}
+
+	failed := false
+	check := func(description string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("ERROR %s: %v\n", description, err)
+		} else {
+			fmt.Printf("OK %s\n", description)
+		}
+	}
+	mount := func(name string) (dfslib.DFS, error) {
+		localPath := filepath.Join(dir, name)
+		os.Mkdir(localPath, 0755)
+		return dfslib.MountDFS(serverAddr, "127.0.0.1", localPath)
+	}
+
+	a, err := mount("a")
+	if err == nil {
+		err = write(a, "doc", "before")
+	}
+	check("mount and write", err)
+
+	// Server down
+	stop(server)
+	time.Sleep(3 * time.Second)
+	err = write(a, "doc", "while down")
+	if _, ok := err.(dfslib.DisconnectedError); ok {
+		err = nil
+	} else {
+		err = fmt.Errorf("got %v", err)
+	}
+	check("writes fail while the server is down", err)
+	check("DREAD reads the local copy while the server is down", read(a, "doc", dfslib.DREAD, "before"))
+
+	server, err = startServer(binary, dir, serverAddr, dataDir)
+	check("start the server again", err)
+	check("mount reconnects once the server is back", writeWithin(40*time.Second, a, "doc", "after restart"))
+	b, err := mount("b")
+	if err == nil {
+		err = read(b, "doc", dfslib.READ, "after restart")
+	}
+	check("other clients read the write made after reconnecting", err)
+
+	// Client whose heartbeats stop for a while
+	os.Mkdir(filepath.Join(dir, "held"), 0755)
+	cmd := exec.Command(os.Args[0], "client", serverAddr, filepath.Join(dir, "held"))
+	input, _ := cmd.StdinPipe()
+	output, _ := cmd.StdoutPipe()
+	cmd.Stderr = os.Stderr
+	held := &childClient{cmd: cmd, input: input, answers: bufio.NewScanner(output)}
+	err = cmd.Start()
+	if err == nil {
+		err = held.write("before gap")
+	}
+	check("client in another process writes", err)
+	cmd.Process.Signal(syscall.SIGSTOP)
+	time.Sleep(heartbeatGap)
+	cmd.Process.Signal(syscall.SIGCONT)
+	// Let the server see the gap before writing
+	time.Sleep(time.Second)
+	check("client dropped after a heartbeat gap mounts again and writes", held.write("after gap"))
+	check("other clients read the write made after mounting again", read(b, "held", dfslib.READ, "after gap"))
+	input.Close()
+	cmd.Wait()
+
+	a.UMountDFS()
+	b.UMountDFS()
+	stop(server)
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,202 @@
+/*
+ * Test of a client finishing the writes a crash cut short, from its write
+ * log, when it mounts again. The crashes are simulated by leaving the local
+ * path as the client would have left it:
+ *
+ * $ go run -race server.go 127.0.0.1:8080
+ * $ go run -race recovery_app.go 127.0.0.1:8080
+ *
+ * - A chunk written locally before the server was told is put back
+ * - A chunk the server took before the client logged the write as complete
+ *   and saved its version is kept, and other clients can read it even when
+ *   the crashed client is the only one holding it
+ * - A chunk the server was being told about but never got is published
+ * - The write log is left with no writes to finish
+ */
+
+package main
+
+import (
+	"./dfslib"
+
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const chunkSize = dfslib.DefaultChunkSize
+
+// Returns chunk holding content
+func chunkOf(content string) *dfslib.Chunk {
+	var chunk dfslib.Chunk
+	copy(chunk[:], content)
+	return &chunk
+}
+
+// Returns the log line of a write to chunkNum of fname made against version base
+func writingLine(fname string, chunkNum int, base int, fileSize int, old string, written string) string {
+	return fmt.Sprintf("WRITING: %d, %s, %d, %d, %s, %s\n", chunkNum, fname, base, fileSize,
+		base64.StdEncoding.EncodeToString(chunkOf(old)[:]), base64.StdEncoding.EncodeToString(chunkOf(written)[:]))
+}
+
+// Sets the version saved for a chunk of fname in localPath
+func setVersion(localPath string, fname string, chunkNum int, version int) error {
+	path := filepath.Join(localPath, fname+".meta")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var meta map[string]interface{}
+	err = json.Unmarshal(data, &meta)
+	if err != nil {
+		return err
+	}
+	meta["Versions"].(map[string]interface{})[fmt.Sprint(chunkNum)] = version
+	data, err = json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Checks the chunks of fname opened for reading hold contents
+func read(dfs dfslib.DFS, fname string, contents map[uint32]string) error {
+	f, err := dfs.Open(fname, dfslib.READ)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for chunkNum, content := range contents {
+		var chunk dfslib.Chunk
+		err = f.Read(chunkNum, &chunk)
+		if err != nil {
+			return fmt.Errorf("chunk %d: %v", chunkNum, err)
+		}
+		if chunk != *chunkOf(content) {
+			return fmt.Errorf("chunk %d holds %q, expected %q", chunkNum, string(chunk[:len(content)]), content)
+		}
+	}
+	return nil
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Println("Usage: go run -race recovery_app.go [server host:ip]")
+		return
+	}
+	serverAddr := os.Args[1]
+	dir, err := ioutil.TempDir("", "recovery")
+	if err != nil {
+		panic("Could not create temporary directory")
+	}
+	defer os.RemoveAll(dir)
+	pathA := filepath.Join(dir, "a")
+	pathB := filepath.Join(dir, "b")
+	os.Mkdir(pathA, 0755)
+	os.Mkdir(pathB, 0755)
+
+	failed := false
+	check := func(description string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Printf("ERROR %s: %v\n", description, err)
+		} else {
+			fmt.Printf("OK %s\n", description)
+		}
+	}
+
+	a, err := dfslib.MountDFS(serverAddr, "127.0.0.1", pathA)
+	if err != nil {
+		fmt.Println("Error: Could not mount:", err)
+		os.Exit(1)
+	}
+	f, err := a.Open("doc", dfslib.WRITE)
+	if err == nil {
+		writes := []struct {
+			chunkNum uint32
+			content  string
+		}{{0, "first 0"}, {1, "first 1"}, {2, "first 2"}, {1, "taken 1"}}
+		for _, w := range writes {
+			err = f.Write(w.chunkNum, chunkOf(w.content))
+			if err != nil {
+				break
+			}
+		}
+		f.Close()
+	}
+	check("write the file", err)
+	a.UMountDFS()
+
+	// Crash after the server took chunk 1: the write isn't logged as complete and its version isn't saved
+	logPath := filepath.Join(pathA, "log.dfs")
+	logged, err := ioutil.ReadFile(logPath)
+	if err == nil {
+		complete := "WRITE COMPLETE: 1, doc\n"
+		last := strings.LastIndex(string(logged), complete)
+		if last < 0 {
+			err = fmt.Errorf("no complete write to chunk 1 in the log")
+		} else {
+			logged = append(logged[:last:last], logged[last+len(complete):]...)
+			err = ioutil.WriteFile(logPath, logged, 0644)
+		}
+	}
+	if err == nil {
+		err = setVersion(pathA, "doc", 1, 1)
+	}
+	check("leave chunk 1 as a crash after the server took it would", err)
+
+	// Crash while writing chunk 0 locally, and while telling the server about chunk 2
+	local, err := os.OpenFile(filepath.Join(pathA, "doc.dfs"), os.O_RDWR, 0644)
+	if err == nil {
+		local.WriteAt(chunkOf("junk 0")[:], 0)
+		local.WriteAt(chunkOf("lost 2")[:], int64(2*chunkSize))
+		local.Close()
+		var logFile *os.File
+		logFile, err = os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprint(logFile, writingLine("doc", 0, 1, 3*chunkSize, "first 0", "junk 0"))
+			fmt.Fprint(logFile, writingLine("doc", 2, 1, 3*chunkSize, "first 2", "lost 2"))
+			fmt.Fprintf(logFile, "SERVER FILES UPDATING: 2, doc\n")
+			logFile.Close()
+		}
+	}
+	check("leave chunks 0 and 2 as crashes while writing them would", err)
+
+	// Mounting again finishes the writes
+	a, err = dfslib.MountDFS(serverAddr, "127.0.0.1", pathA)
+	if err != nil {
+		fmt.Println("Error: Could not mount again:", err)
+		os.Exit(1)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(pathA, "doc.dfs"))
+	if err == nil && (len(data) < 3*chunkSize || *chunkOf("first 0") != *chunkOf(string(data[:chunkSize]))) {
+		err = fmt.Errorf("local copy holds %q", data)
+	}
+	check("chunk the server wasn't told about is put back", err)
+	logged, err = ioutil.ReadFile(logPath)
+	if err == nil && len(logged) > 0 {
+		err = fmt.Errorf("log holds %q", logged)
+	}
+	check("write log has no writes left to finish", err)
+
+	b, err := dfslib.MountDFS(serverAddr, "127.0.0.1", pathB)
+	if err == nil {
+		err = read(b, "doc", map[uint32]string{0: "first 0", 1: "taken 1", 2: "lost 2"})
+	}
+	check("other clients read the chunks the crashed client finished", err)
+	info, err := b.Stat("doc")
+	if err == nil && (info.Versions[0] != 1 || info.Versions[1] != 2 || info.Versions[2] != 2) {
+		err = fmt.Errorf("versions %v", info.Versions)
+	}
+	check("only the chunks the server took are new versions", err)
+
+	a.UMountDFS()
+	b.UMountDFS()
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	//"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"./raft"
 	"./shared"
 )
 
@@ -28,12 +39,103 @@ const (
 
 	// Disconnected read mode.
 	DREAD
+
+	// Chunk write mode.
+	CWRITE
+
+	// Disconnected write mode.
+	DWRITE
+)
+
+// Largest chunk number, a lock up to it covers the whole file
+const lastChunk = ^uint32(0)
+
+const (
+	// Files in the server data directory
+	snapshotFile = "snapshot.json"
+	logFile      = "wal.log"
+	chunkDir     = "chunks"
+	backupFile   = "backup" // Address of the backup that registered last
+
+	// Log records written before the log is folded into a new snapshot
+	snapshotInterval = 1000
+
+	// How long a write lease lasts unless its client renews it
+	leaseDuration = 10 * time.Second
+
+	// How long write access held before a restart is kept for its client to come back
+	recoveredGrantTimeout = 30 * time.Second
+
+	// Gap between heartbeats after which a client is disconnected, clients send one every 2 seconds
+	heartbeatTimeout = 4 * time.Second
+
+	// How long the primary waits for its backup to copy a log record before replying without it
+	replicationTimeout = 2 * time.Second
+
+	// How long a backup's request for log records waits for new ones, it doubles as a ping
+	followTimeout = time.Second
+
+	// Failed requests in a row after which a backup takes over from its primary
+	followFailures = 3
+
+	// How long a primary with a backup keeps serving clients after the backup last asked it for records
+	// The backup only takes over once twice that has passed since the primary last answered it
+	primaryLease = 3 * followTimeout
+
+	// How long a raft leader waits for a log record to be committed before failing the call
+	commitTimeout = 2 * time.Second
+
+	// How often a raft member checks whether it leads the group
+	leaderCheckInterval = 100 * time.Millisecond
+
+	// Chunk versions waiting to be pushed to other clients, more are dropped until the queue drains
+	pushBacklog = 256
+
+	// How often the server looks for chunks with fewer live copies than the replication factor
+	repairInterval = 2 * time.Second
+
+	// How long a push waits on a client to store or hand over a chunk before moving on to the next one
+	pushTimeout = 3 * time.Second
 )
 
 func main() {
 	// check that command line args present
+	// Usage: go run server.go [ip:port] [data directory] [-store] [-replicas n] [primary ip:port]
+	//    or: go run server.go [ip:port] [data directory] [-store] [-replicas n] -raft [own raft ip:port] [other raft ip:port]...
+	// With -store, the server keeps a copy of every chunk written so files stay readable with their clients offline
+	// With -replicas, every chunk written is pushed to n connected clients besides its writer
+	// Given a primary, the server is its backup and only serves clients once the primary fails
+	// A primary stops serving clients while its backup isn't following, since the backup may have taken over,
+	// and after a restart waits for it to follow again. Remove backup from its data directory to run it alone
+	// Given raft members, the server only serves clients while it leads the group
+	// Without a data directory, each address gets its own one in the temp directory
 	args := os.Args[1:]
-	if len(args) != 1 {
+	if len(args) < 1 {
+		log.Fatal("Not enough arguments in call")
+	}
+	dataDir := filepath.Join(os.TempDir(), "dfs-server-"+strings.Replace(args[0], ":", "-", -1))
+	if len(args) >= 2 {
+		dataDir = args[1]
+	}
+	var options []string
+	if len(args) > 2 {
+		options = args[2:]
+	}
+	store := len(options) > 0 && options[0] == "-store"
+	if store {
+		options = options[1:]
+	}
+	replicas := 0
+	if len(options) >= 2 && options[0] == "-replicas" {
+		n, err := strconv.Atoi(options[1])
+		if err != nil || n < 0 {
+			log.Fatal("Bad replication factor: ", options[1])
+		}
+		replicas = n
+		options = options[2:]
+	}
+	raftGroup := len(options) >= 2 && options[0] == "-raft"
+	if len(options) > 1 && !raftGroup {
 		log.Fatal("Not enough arguments in call")
 	}
 
@@ -44,48 +146,147 @@ func main() {
 	dfs.ClientInfo = make(map[string]*shared.ClientMetadata)
 	dfs.Access = make(map[string]string)
 	dfs.ClientFiles = make(map[string][]*shared.FileMetadata)
-	dfs.FileVersions = make(map[string][256]int)
+	dfs.FileVersions = make(map[string]map[uint32]int)
+	dfs.ChunkSizes = make(map[string]int)
 	dfs.Files = make(map[string][]string)
+	dfs.Directories = make(map[string]bool)
+	dfs.PendingChanges = make(map[string][]shared.NamespaceChange)
+	dfs.Watchers = make(map[string][]string)
 	dfs.Heartbeat = make(map[string]time.Time)
+	dfs.HeartbeatReceived = make(map[string]time.Time)
 	dfs.HeartbeatDisconnected = make(map[string]bool)
 	dfs.Originals = make(map[string][]string)
 	dfs.ClientsWriting = make(map[string]string)
 	dfs.Clients = make(map[string]*rpc.Client)
+	dfs.LeaseEpochs = make(map[string]int)
+	dfs.LeaseOpens = make(map[string]int)
+	dfs.LeaseExpiry = make(map[string]time.Time)
+	dfs.WriteQueue = make(map[string][]*writeWaiter)
+	dfs.ChunkLocks = make(map[string][]*chunkLock)
+	dfs.replica = newReplication("")
+	dfs.Addr = os.Args[1]
+	if store {
+		var err error
+		dfs.Store, err = newChunkStore(filepath.Join(dataDir, chunkDir))
+		if err != nil {
+			log.Fatal("Could not open chunk store: ", err)
+		}
+	}
+	if replicas > 0 {
+		dfs.Replicas = replicas
+		dfs.pushes = make(chan chunkPush, pushBacklog)
+		dfs.repairs = newRepairs()
+		go dfs.pushReplicas()
+		go dfs.repairReplicas()
+	}
+
+	if raftGroup {
+		// The raft log holds the metadata, it is applied as the group commits it
+		dfs.proposed = make(map[int]int)
+		dfs.mutex.Lock()
+		rf, err := raft.Start(options[1], options[2:], dataDir, dfs.applyCommitted)
+		dfs.Raft = rf
+		dfs.mutex.Unlock()
+		if err != nil {
+			log.Fatal("Could not start raft: ", err)
+		}
+		dfs.lead()
+		return
+	}
 
-	addr := os.Args[1]
+	// Load metadata saved before the last shutdown or crash
+	err := dfs.Recover(dataDir)
+	if err != nil {
+		log.Fatal("Could not recover server metadata: ", err)
+	}
+
+	if len(options) == 1 {
+		// Copy the primary's metadata until it fails
+		dfs.followPrimary(options[0])
+		dfs.takeOver()
+	}
+
+	err = dfs.serveClients(nil)
+	if err != nil {
+		log.Fatal("Listening error occurred: ", err)
+	}
+}
+
+// Serves clients at the server's address until stop is closed, a nil stop never is
+func (d *DFSServerInstance) serveClients(stop <-chan struct{}) error {
 	// Create heartbeat server in another goroutine
-	serverAddr, _ := net.ResolveUDPAddr("udp", addr)
-	heartbeat, _ := net.ListenUDP("udp", serverAddr)
-	dfs.HeartbeatServer = heartbeat
-	go UDPHeartbeatListener(heartbeat, dfs)
+	serverAddr, _ := net.ResolveUDPAddr("udp", d.Addr)
+	heartbeat, err := net.ListenUDP("udp", serverAddr)
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	d.HeartbeatServer = heartbeat
+	d.mutex.Unlock()
+	go UDPHeartbeatListener(heartbeat, d, stop)
 
 	// Get address of client-incoming ip:port
 	//fmt.Printf("\nListening for clients at:%v...\n", addr)
-	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	tcpAddr, err := net.ResolveTCPAddr("tcp", d.Addr)
 	if err != nil {
 		//fmt.Println("Problem resolvin addr:%s\n", addr)
 	}
 
 	listener, err := net.ListenTCP("tcp", tcpAddr)
 	if err != nil {
-		log.Fatal("Listening error occurred: ", err)
+		heartbeat.Close()
+		return err
 	}
 	server := rpc.NewServer()
-	server.Register(dfs)
+	server.Register(d)
+
+	var conns []net.Conn
+	var connsMutex sync.Mutex
+	if stop != nil {
+		go func() {
+			<-stop
+			listener.Close()
+			heartbeat.Close()
+			connsMutex.Lock()
+			for _, conn := range conns {
+				conn.Close()
+			}
+			connsMutex.Unlock()
+		}()
+	}
 
 	// Serve in another goroutine
 	for {
 		// Accept connections and block until listener receives non-nil error
-		conn, _ := listener.Accept()
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+				continue
+			}
+		}
+		connsMutex.Lock()
+		conns = append(conns, conn)
+		connsMutex.Unlock()
 		go server.ServeConn(conn)
 	}
 }
 
-// Listen for heartbeats
-func UDPHeartbeatListener(listener *net.UDPConn, dfs *DFSServerInstance) {
+// Listen for heartbeats until stop is closed
+func UDPHeartbeatListener(listener *net.UDPConn, dfs *DFSServerInstance, stop <-chan struct{}) {
 	buffer := make([]byte, 1024)
 	for {
-		size, _ := listener.Read(buffer[0:])
+		size, err := listener.Read(buffer[0:])
+		if err != nil {
+			select {
+			case <-stop:
+				return
+			default:
+				continue
+			}
+		}
 		if len(buffer) > 0 {
 			//fmt.Printf("Buffer contents:%s, size:%d\n", buffer, len(buffer))
 			ReportHeartbeat(buffer[:size], dfs)
@@ -99,44 +300,107 @@ func ReportHeartbeat(buffer []byte, dfs *DFSServerInstance) {
 
 	_ = json.Unmarshal(buffer, &heartbeat)
 
+	dfs.mutex.Lock()
+	defer dfs.mutex.Unlock()
+
 	// Get previous heartbeat time
 	lastHeartbeat := dfs.Heartbeat[heartbeat.LocalPath]
 
 	// Save new heartbeat time
 	newHeartbeat := heartbeat.TimeSent
 	dfs.Heartbeat[heartbeat.LocalPath] = newHeartbeat
+	dfs.HeartbeatReceived[heartbeat.LocalPath] = time.Now()
 
-	// Get time difference
+	// Get time difference, the first heartbeat after mounting has nothing to compare to
 	duration := newHeartbeat.Sub(lastHeartbeat)
-	if duration > 2 {
+	if !lastHeartbeat.IsZero() && duration > heartbeatTimeout {
 		//fmt.Printf("DISCONNECTED CLIENT %v\n", heartbeat.LocalPath)
 		dfs.ConnectedClients[heartbeat.LocalPath] = "Disconnected"
 		dfs.HeartbeatDisconnected[heartbeat.LocalPath] = true
 		// Remove write access
 		filename, exists := dfs.ClientsWriting[heartbeat.LocalPath]
 		if exists {
-			delete(dfs.ClientsWriting, heartbeat.LocalPath)
-			delete(dfs.Access, filename)
+			dfs.revokeAccess(filename)
+			dfs.logChanges([]string{filename}, []string{heartbeat.LocalPath}, nil)
+		}
+		if released := dfs.releaseChunkLocks(heartbeat.LocalPath); len(released) > 0 {
+			dfs.logChanges(released, nil, nil)
 		}
 	}
 }
 
 type DFSServerInstance struct {
 	// Metadata
-	Count                 int                               // ID to give to servers
-	Originals             map[string][]string               // map original to new given localPath
-	ConnectedClients      map[string]string                 // record clients connected to server ie: [Client1:Connected]
-	ClientInfo            map[string]*shared.ClientMetadata // Information about clients (addr, localpath, files) ie: [/tmp/dev: stuff about client]
-	Access                map[string]string                 // Which clients reading/writing ie:
-	ClientFiles           map[string][]*shared.FileMetadata // what files do clients have [/tmp/dev/2: List of Files]
-	FileVersions          map[string][256]int               // Files with list of their versions
-	Files                 map[string][]string               // What files are in network and what client has them
-	Client                *rpc.Client                       // Client to send rpc to other Clients
+	Count                 int                                 // ID to give to servers
+	Originals             map[string][]string                 // map original to new given localPath
+	ConnectedClients      map[string]string                   // record clients connected to server ie: [Client1:Connected]
+	ClientInfo            map[string]*shared.ClientMetadata   // Information about clients (addr, localpath, files) ie: [/tmp/dev: stuff about client]
+	Access                map[string]string                   // Which clients reading/writing ie:
+	ClientFiles           map[string][]*shared.FileMetadata   // what files do clients have [/tmp/dev/2: List of Files]
+	FileVersions          map[string]map[uint32]int           // Files with the latest version of each chunk written
+	ChunkSizes            map[string]int                      // Bytes per chunk of each file
+	Files                 map[string][]string                 // What files are in network and what client has them
+	Directories           map[string]bool                     // Directories in the namespace, the root "" always exists
+	PendingChanges        map[string][]shared.NamespaceChange // Removals/renames to apply to a client's local files on its next mount
+	Watchers              map[string][]string                 // Clients to notify when a chunk of a file is written ie: [file: [/tmp/dev, ...]]
+	Client                *rpc.Client                         // Client to send rpc to other Clients
 	Clients               map[string]*rpc.Client
 	Heartbeat             map[string]time.Time // Client's latest heartbeat
+	HeartbeatReceived     map[string]time.Time // When the server got each client's latest heartbeat, by the server's clock
 	HeartbeatDisconnected map[string]bool      //Records whether client disconnected
 	HeartbeatServer       *net.UDPConn
 	ClientsWriting        map[string]string
+	LeaseEpochs           map[string]int            // Epoch of the latest write lease granted on each file, never goes down
+	LeaseExpiry           map[string]time.Time      // When the write lease in Access runs out unless renewed
+	LeaseOpens            map[string]int            // Opens sharing the write lease in Access, it is given back when all are closed
+	WriteQueue            map[string][]*writeWaiter // Clients waiting for write access to each file, in arrival order
+	ChunkLocks            map[string][]*chunkLock   // Write locks on chunk ranges of each file
+	Addr                  string                    // Address clients reach this server at
+
+	// RPCs are served concurrently, every handler holds mutex while it uses the maps above
+	// Calls to clients are made without holding it so a slow client doesn't stall the server
+	mutex sync.RWMutex
+
+	// Persistence
+	Store      *chunkStore // Copies of chunks written, nil unless the server was started with -store
+	DataDir    string      // Where the snapshot and write-ahead log are kept
+	Log        *os.File    // Write-ahead log of changes since the snapshot
+	LogRecords int         // Records in Log
+	logged     int         // Records logged since the server started
+	logMutex   sync.Mutex  // Serializes writes to Log and snapshots
+
+	// Replication
+	replica   *replication // Log records not yet copied by the backup
+	Raft      *raft.Raft   // Raft group the metadata log is replicated in, nil if not in one
+	proposed  map[int]int  // Term of each log entry proposed while leading and not yet applied, by index
+	readyTerm int          // Term of the latest leader whose first log entry is applied
+
+	// Latest log entry proposed, guarded by logMutex
+	proposedIndex int
+	proposedTerm  int
+
+	// Chunk replicas
+	Replicas int            // Clients each new chunk version is pushed to besides its writer, 0 pushes none
+	pushes   chan chunkPush // Chunk versions waiting to be pushed, in the order they were written
+	repairs  *repairs       // Chunks queued to get back to the replication factor
+}
+
+// Client waiting in WaitWriteable for write access to a file
+type writeWaiter struct {
+	localPath string
+	ticket    uint64        // Picked by the client to cancel the wait
+	epoch     int           // Epoch of the lease granted, 0 if the wait was cancelled
+	granted   chan struct{} // Closed when the wait is over
+}
+
+// Write lock on chunks First to Last of a file held by a client in CWRITE mode
+// Locks on one file are numbered with the same epochs as write leases
+type chunkLock struct {
+	LocalPath string
+	First     uint32
+	Last      uint32
+	Epoch     int
+	expiry    time.Time // When the lock runs out unless renewed
 }
 
 func NewDFSServerInstance() *DFSServerInstance {
@@ -146,6 +410,7 @@ func NewDFSServerInstance() *DFSServerInstance {
 // Connect to client RPC server
 // Add initial client info to server metadata
 func (d *DFSServerInstance) Mount(args *shared.Args, reply *shared.Reply) (err error) {
+	defer d.awaitLogged(d.loggedCount(), &err)
 	connected := true
 
 	// Connect to client
@@ -155,68 +420,527 @@ func (d *DFSServerInstance) Mount(args *shared.Args, reply *shared.Reply) (err e
 		connected = false
 	}
 
-	//d.Client = conn
-	d.Clients[args.LocalPath] = conn
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 
-	// TODO find an empty disconnected Client slot number
-	// Good to have but dw about this for now - max num of clients in assgmt is 16
+	// A client that mounted before keeps its name even if another client now uses its local path
+	localPath, returning := d.clientName(args.UUID, args.LocalPath)
+
+	// The connection from an earlier mount is replaced
+	if old := d.Clients[localPath]; old != nil && old != conn {
+		old.Close()
+	}
+	//d.Client = conn
+	d.Clients[localPath] = conn
 
-	// Ignore this new path thing for now?
-	//newLocalPath := fmt.Sprintf("%s%d/", args.LocalPath, d.Count)
 	client := &shared.ClientMetadata{
 		ID:        d.Count,
 		Addr:      args.Addr,
 		LocalPath: args.LocalPath,
+		UUID:      args.UUID,
+	}
+	if returning {
+		client.ID = d.ClientInfo[localPath].ID
+	} else {
+		d.Count++
 	}
 
+	// The client reports the files in its local path, which may have changed while it was away
+	files, changed := d.takeInventory(localPath, args.Files, d.PendingChanges[localPath])
+	client.Files = files
+
 	// Remove old data if client has mounted before
-	delete(d.Access, args.LocalPath)
-	delete(d.Heartbeat, args.LocalPath)
-	delete(d.ClientsWriting, args.LocalPath)
-	delete(d.HeartbeatDisconnected, args.LocalPath)
+	// Files it was writing are no longer open so give back write access
+	released := d.releaseGrants(localPath)
+	delete(d.Heartbeat, localPath)
+	delete(d.HeartbeatDisconnected, localPath)
+	d.HeartbeatReceived[localPath] = time.Now()
+	d.removeWatcher(localPath)
 
 	if !connected {
-		d.ConnectedClients[client.LocalPath] = "Disconnected"
+		d.ConnectedClients[localPath] = "Disconnected"
 	} else {
-		d.ConnectedClients[client.LocalPath] = "Connected"
+		d.ConnectedClients[localPath] = "Connected"
 	}
-	d.ClientInfo[client.LocalPath] = client
-	reply.ID = d.Count
-	reply.LocalPath = client.LocalPath
-	//fmt.Printf("Client %s is connected.\n", client.LocalPath)
-	d.Count++
+	d.ClientInfo[localPath] = client
+	reply.ID = client.ID
+	reply.LocalPath = localPath
+	// Hand over removals/renames missed while disconnected
+	reply.Changes = d.PendingChanges[localPath]
+	delete(d.PendingChanges, localPath)
+	reply.Servers = d.servers()
+	//fmt.Printf("Client %s is connected.\n", localPath)
 
-	return nil
+	return d.logChanges(append(released, changed...), []string{localPath}, nil)
+}
+
+// Sets the files client localPath has to the ones it reported on mount, changed by the
+// removals and renames it is about to be handed
+// Versions newer than the latest written were never published, so the client's copy of
+// those chunks can't be trusted and counts as having none
+// Returns the files reported and the files whose holders changed
+func (d *DFSServerInstance) takeInventory(localPath string, reported []*shared.FileMetadata, pending []shared.NamespaceChange) ([]*shared.FileMetadata, []string) {
+	kept := make(map[string]*shared.FileMetadata)
+	for _, file := range reported {
+		kept[file.Name] = file
+	}
+	for _, change := range pending {
+		file, exists := kept[change.Filename]
+		if !exists {
+			continue
+		}
+		delete(kept, change.Filename)
+		if change.NewName != "" {
+			kept[change.NewName] = file
+		}
+	}
+
+	var files []*shared.FileMetadata
+	var changed []string
+	for name, file := range kept {
+		latest, exists := d.FileVersions[name]
+		if !exists || (file.ChunkSize > 0 && file.ChunkSize != d.ChunkSizes[name]) {
+			// Removed, or removed and created again, while the client was away
+			delete(kept, name)
+			continue
+		}
+		versions := make(map[uint32]int)
+		for chunkNum, version := range file.Versions {
+			if version > 0 && version <= latest[chunkNum] {
+				versions[chunkNum] = version
+			}
+		}
+		files = append(files, &shared.FileMetadata{
+			Name:      name,
+			Versions:  versions,
+			ChunkSize: d.ChunkSizes[name],
+		})
+		if !contains(d.Files[name], localPath) {
+			d.Files[name] = append(d.Files[name], localPath)
+			changed = append(changed, name)
+		}
+	}
+	for _, file := range d.ClientFiles[localPath] {
+		if _, exists := kept[file.Name]; exists || !contains(d.Files[file.Name], localPath) {
+			continue
+		}
+		var holders []string
+		for _, holder := range d.Files[file.Name] {
+			if holder != localPath {
+				holders = append(holders, holder)
+			}
+		}
+		d.Files[file.Name] = holders
+		changed = append(changed, file.Name)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name < files[j].Name
+	})
+	d.ClientFiles[localPath] = files
+	return files, changed
+}
+
+// Returns the name the server knows the client with uuid mounting from localPath by,
+// and true if the client mounted before
+// A new client is named by its local path, with a number added if another client has that name
+func (d *DFSServerInstance) clientName(uuid string, localPath string) (string, bool) {
+	if uuid != "" {
+		for name, info := range d.ClientInfo {
+			if info.UUID == uuid {
+				return name, true
+			}
+		}
+	}
+	name := localPath
+	for n := 2; ; n++ {
+		info, exists := d.ClientInfo[name]
+		if !exists {
+			return name, false
+		}
+		// Clients without a uuid can only be told apart by their local path,
+		// and are never the same client as one with a uuid
+		if info.UUID == "" && uuid == "" {
+			return name, false
+		}
+		name = localPath + "#" + strconv.Itoa(n)
+	}
 }
 
+// If LocalPath is given, access is only removed if that client holds it
+// If Epoch is given, access is only removed if it is still the lease of that epoch,
+// and only once every open sharing the lease gave it back
 func (d *DFSServerInstance) RemoveAccess(args *shared.Args, reply *shared.Reply) (err error) {
+	defer d.awaitLogged(d.loggedCount(), &err)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	localPath, _ := d.Access[args.Filename]
-	delete(d.Access, args.Filename)
+	if args.LocalPath != "" && localPath != args.LocalPath {
+		return nil
+	}
+	if args.Epoch != 0 && args.Epoch != d.LeaseEpochs[args.Filename] {
+		return nil
+	}
+	if args.Epoch != 0 && d.LeaseOpens[args.Filename] > 1 {
+		// Another open of the same client still uses the lease
+		d.LeaseOpens[args.Filename]--
+	} else {
+		d.revokeAccess(args.Filename)
+	}
+	return d.logChanges([]string{args.Filename}, []string{localPath}, nil)
+}
+
+// Removes write access to filename from the client holding it
+func (d *DFSServerInstance) revokeAccess(filename string) {
+	writer, exists := d.Access[filename]
+	if !exists {
+		return
+	}
+	delete(d.Access, filename)
+	delete(d.LeaseExpiry, filename)
+	delete(d.LeaseOpens, filename)
+	if d.ClientsWriting[writer] == filename {
+		delete(d.ClientsWriting, writer)
+	}
+	d.grantNext(filename)
+}
+
+// Removes write access to every file held by client localPath and its waits for access
+// Returns the files released
+func (d *DFSServerInstance) releaseGrants(localPath string) []string {
+	for filename := range d.WriteQueue {
+		d.dropWaiters(filename, func(w *writeWaiter) bool {
+			return w.localPath == localPath
+		})
+	}
+
+	var released []string
+	for filename, writer := range d.Access {
+		if writer == localPath {
+			released = append(released, filename)
+		}
+	}
+	for _, filename := range released {
+		d.revokeAccess(filename)
+	}
 	delete(d.ClientsWriting, localPath)
+	return append(released, d.releaseChunkLocks(localPath)...)
+}
+
+// Removes every chunk lock held by client localPath
+// Returns the files that had locks removed
+func (d *DFSServerInstance) releaseChunkLocks(localPath string) []string {
+	var released []string
+	for filename := range d.ChunkLocks {
+		if d.dropChunkLocks(filename, func(lock *chunkLock) bool {
+			return lock.LocalPath == localPath
+		}) {
+			released = append(released, filename)
+		}
+	}
+	return released
+}
+
+// Removes the chunk locks on filename for which drop returns true
+// Returns true if any lock was removed, the file then goes to the next client waiting for it
+func (d *DFSServerInstance) dropChunkLocks(filename string, drop func(lock *chunkLock) bool) bool {
+	var kept []*chunkLock
+	for _, lock := range d.ChunkLocks[filename] {
+		if !drop(lock) {
+			kept = append(kept, lock)
+		}
+	}
+	if len(kept) == len(d.ChunkLocks[filename]) {
+		return false
+	}
+	if len(kept) == 0 {
+		delete(d.ChunkLocks, filename)
+	} else {
+		d.ChunkLocks[filename] = kept
+	}
+	if len(d.Access[filename]) == 0 {
+		d.grantNext(filename)
+	}
+	return true
+}
+
+// Returns true if a client other than localPath holds a chunk lock overlapping first to last
+func (d *DFSServerInstance) chunkConflict(filename string, localPath string, first uint32, last uint32) bool {
+	for _, lock := range d.ChunkLocks[filename] {
+		if lock.LocalPath != localPath && lock.First <= last && first <= lock.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the unexpired chunk lock with epoch held by client localPath, nil if there is none
+func (d *DFSServerInstance) chunkLockHeld(filename string, localPath string, epoch int) *chunkLock {
+	for _, lock := range d.ChunkLocks[filename] {
+		if lock.LocalPath == localPath && lock.Epoch == epoch && time.Now().Before(lock.expiry) {
+			return lock
+		}
+	}
+	return nil
+}
+
+// Returns true if any client holds write access to filename or a chunk lock on it
+func (d *DFSServerInstance) writeLocked(filename string) bool {
+	return len(d.Access[filename]) > 0 || len(d.ChunkLocks[filename]) > 0
+}
+
+// Locks chunks Chunknum to LastChunk of Filename for writing by LocalPath in CWRITE mode
+// The lock has an Epoch and lasts Lease unless renewed with RenewLease
+// Writeable is false if any client writes to the whole file, LocalPath too since the lock's
+// epoch would end its lease, another client holds an overlapping lock
+// or is waiting for write access to the whole file
+func (d *DFSServerInstance) LockChunks(args *shared.Args, reply *shared.Reply) (err error) {
+	defer d.awaitLogged(d.loggedCount(), &err)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if args.Chunknum > args.LastChunk {
+		return errors.New("Error because the chunk range is empty.")
+	}
+	d.expireLease(args.Filename)
+	if len(d.Access[args.Filename]) > 0 ||
+		d.chunkConflict(args.Filename, args.LocalPath, args.Chunknum, args.LastChunk) ||
+		len(d.WriteQueue[args.Filename]) > 0 {
+		reply.Writeable = false
+		return nil
+	}
+
+	d.LeaseEpochs[args.Filename]++
+	lock := &chunkLock{
+		LocalPath: args.LocalPath,
+		First:     args.Chunknum,
+		Last:      args.LastChunk,
+		Epoch:     d.LeaseEpochs[args.Filename],
+		expiry:    time.Now().Add(leaseDuration),
+	}
+	d.ChunkLocks[args.Filename] = append(d.ChunkLocks[args.Filename], lock)
+	reply.Writeable = true
+	reply.Epoch = lock.Epoch
+	reply.Lease = leaseDuration
+	return d.logChanges([]string{args.Filename}, nil, nil)
+}
+
+// Removes the chunk lock of epoch Epoch on Filename held by LocalPath
+func (d *DFSServerInstance) UnlockChunks(args *shared.Args, reply *shared.Reply) (err error) {
+	defer d.awaitLogged(d.loggedCount(), &err)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.dropChunkLocks(args.Filename, func(lock *chunkLock) bool {
+		return lock.LocalPath == args.LocalPath && lock.Epoch == args.Epoch
+	}) {
+		return d.logChanges([]string{args.Filename}, nil, nil)
+	}
 	return nil
 }
 
 // If file is already being written to, return false
 // Else return true and update server to know it's being written to
+// In WRITE mode the client gets a lease, with its Epoch, that lasts Lease unless renewed
+// A client asking again for a file it holds keeps its lease and epoch
 func (d *DFSServerInstance) Writeable(args *shared.Args, reply *shared.Reply) (err error) {
+	defer d.awaitLogged(d.loggedCount(), &err)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.expireLease(args.Filename)
 	writer := d.Access[args.Filename]
-	if len(d.Access[args.Filename]) > 0 && writer != args.LocalPath {
+	if (len(writer) > 0 && writer != args.LocalPath) || d.chunkConflict(args.Filename, args.LocalPath, 0, lastChunk) {
 		//fmt.Printf("File %f is not writable, being written to by %s\n", args.Filename, writer)
 		reply.Writeable = false
 	} else {
 		reply.Writeable = true
 		//Tell server we're writing
 		if args.Mode == int(WRITE) {
-			d.Access[args.Filename] = args.LocalPath
-			d.ClientsWriting[args.LocalPath] = args.Filename
+			reply.Epoch = d.grantLease(args.Filename, args.LocalPath)
+			reply.Lease = leaseDuration
+			return d.logChanges([]string{args.Filename}, []string{args.LocalPath}, nil)
+		}
+	}
+	return nil
+}
+
+// Like Writeable in WRITE mode, but if another client is writing waits until
+// every client that asked before has had write access and given it back
+// Returns with Writeable false if CancelWait is called with the same Ticket
+func (d *DFSServerInstance) WaitWriteable(args *shared.Args, reply *shared.Reply) (err error) {
+	defer d.awaitLogged(d.loggedCount(), &err)
+	d.mutex.Lock()
+	d.expireLease(args.Filename)
+	writer := d.Access[args.Filename]
+	if (len(writer) == 0 || writer == args.LocalPath) && !d.chunkConflict(args.Filename, args.LocalPath, 0, lastChunk) {
+		reply.Writeable = true
+		reply.Epoch = d.grantLease(args.Filename, args.LocalPath)
+		reply.Lease = leaseDuration
+		err = d.logChanges([]string{args.Filename}, []string{args.LocalPath}, nil)
+		d.mutex.Unlock()
+		return err
+	}
+	w := &writeWaiter{
+		localPath: args.LocalPath,
+		ticket:    args.Ticket,
+		granted:   make(chan struct{}),
+	}
+	d.WriteQueue[args.Filename] = append(d.WriteQueue[args.Filename], w)
+	d.mutex.Unlock()
+
+	for {
+		// Wake up when a lease or lock runs out in case its client stopped renewing it
+		d.mutex.RLock()
+		wake := time.Until(d.nextExpiry(args.Filename))
+		d.mutex.RUnlock()
+		if wake < 100*time.Millisecond {
+			wake = 100 * time.Millisecond
+		}
+
+		select {
+		case <-w.granted:
+			reply.Writeable = w.epoch > 0
+			reply.Epoch = w.epoch
+			reply.Lease = leaseDuration
+			return nil
+		case <-time.After(wake):
+			d.mutex.Lock()
+			d.expireLease(args.Filename)
+			d.mutex.Unlock()
+		}
+	}
+}
+
+// Stops the WaitWriteable call of client LocalPath with Ticket on Filename
+// Access granted before the call arrives is kept, the client has to give it back
+func (d *DFSServerInstance) CancelWait(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.dropWaiters(args.Filename, func(w *writeWaiter) bool {
+		return w.localPath == args.LocalPath && w.ticket == args.Ticket
+	})
+	return nil
+}
+
+// Removes the waiters on filename for which drop returns true
+// Their WaitWriteable calls return without write access
+func (d *DFSServerInstance) dropWaiters(filename string, drop func(w *writeWaiter) bool) {
+	var kept []*writeWaiter
+	for _, w := range d.WriteQueue[filename] {
+		if drop(w) {
+			close(w.granted)
+		} else {
+			kept = append(kept, w)
+		}
+	}
+	if len(kept) == 0 {
+		delete(d.WriteQueue, filename)
+	} else {
+		d.WriteQueue[filename] = kept
+	}
+}
+
+// Gives the write lease on filename to localPath and returns its epoch
+// A client that already holds the lease keeps its epoch and has the lease extended,
+// the lease is shared by its opens until each gives it back
+func (d *DFSServerInstance) grantLease(filename string, localPath string) int {
+	if d.Access[filename] != localPath {
+		d.LeaseEpochs[filename]++
+		d.Access[filename] = localPath
+		d.ClientsWriting[localPath] = filename
+		d.LeaseOpens[filename] = 0
+	}
+	d.LeaseOpens[filename]++
+	d.LeaseExpiry[filename] = time.Now().Add(leaseDuration)
+	return d.LeaseEpochs[filename]
+}
+
+// Gives write access to filename to the client that has waited longest for it
+func (d *DFSServerInstance) grantNext(filename string) {
+	queue := d.WriteQueue[filename]
+	if len(queue) == 0 || d.chunkConflict(filename, queue[0].localPath, 0, lastChunk) {
+		return
+	}
+	w := queue[0]
+	if len(queue) == 1 {
+		delete(d.WriteQueue, filename)
+	} else {
+		d.WriteQueue[filename] = queue[1:]
+	}
+	w.epoch = d.grantLease(filename, w.localPath)
+	close(w.granted)
+	d.logChanges([]string{filename}, []string{w.localPath}, nil)
+}
+
+// Takes write access to filename and chunk locks on it away from their clients if they have run out
+func (d *DFSServerInstance) expireLease(filename string) {
+	now := time.Now()
+	if d.dropChunkLocks(filename, func(lock *chunkLock) bool {
+		return !now.Before(lock.expiry)
+	}) {
+		d.logChanges([]string{filename}, nil, nil)
+	}
+
+	writer := d.Access[filename]
+	if len(writer) == 0 || now.Before(d.LeaseExpiry[filename]) {
+		return
+	}
+	d.revokeAccess(filename)
+	d.logChanges([]string{filename}, []string{writer}, nil)
+}
+
+// Returns when the next lease or chunk lock on filename runs out, zero if there is none
+func (d *DFSServerInstance) nextExpiry(filename string) time.Time {
+	next := d.LeaseExpiry[filename]
+	for _, lock := range d.ChunkLocks[filename] {
+		if next.IsZero() || lock.expiry.Before(next) {
+			next = lock.expiry
 		}
 	}
+	return next
+}
+
+// Returns true if client localPath holds an unexpired write lease on filename with epoch
+func (d *DFSServerInstance) leaseHeld(filename string, localPath string, epoch int) bool {
+	return d.Access[filename] == localPath &&
+		d.LeaseEpochs[filename] == epoch &&
+		time.Now().Before(d.LeaseExpiry[filename])
+}
+
+// Extends the write lease or chunk lock of epoch Epoch on Filename held by LocalPath
+// Writeable is false if it has run out or was given to another client
+func (d *DFSServerInstance) RenewLease(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if lock := d.chunkLockHeld(args.Filename, args.LocalPath, args.Epoch); lock != nil {
+		lock.expiry = time.Now().Add(leaseDuration)
+	} else if d.leaseHeld(args.Filename, args.LocalPath, args.Epoch) {
+		d.LeaseExpiry[args.Filename] = time.Now().Add(leaseDuration)
+	} else {
+		reply.Writeable = false
+		return nil
+	}
+	reply.Writeable = true
+	reply.Epoch = args.Epoch
+	reply.Lease = leaseDuration
 	return nil
 }
 
 // Update chunk to some version
+// Writeable is false, and nothing changes, if the client's write lease of epoch Epoch has lapsed
+// or Epoch is a chunk lock that doesn't cover Chunknum
+// Conflict is true, and nothing changes, if a Disconnected write's Version is no longer the latest
 func (d *DFSServerInstance) UpdateChunkVersion(args *shared.Args, reply *shared.Reply) (err error) {
-	clientInfo := d.ClientInfo[args.LocalPath]
+	defer d.awaitLogged(d.loggedCount(), &err)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	lock := d.chunkLockHeld(args.Filename, args.LocalPath, args.Epoch)
+	ownsChunk := lock != nil && lock.First <= args.Chunknum && args.Chunknum <= lock.Last
+	if !ownsChunk && !d.leaseHeld(args.Filename, args.LocalPath, args.Epoch) {
+		reply.Writeable = false
+		return nil
+	}
+	clientInfo, exists := d.ClientInfo[args.LocalPath]
+	if !exists {
+		return errors.New("Error because client is not mounted.")
+	}
 	files := clientInfo.Files
 	var file *shared.FileMetadata
 	var index int
@@ -226,13 +950,25 @@ func (d *DFSServerInstance) UpdateChunkVersion(args *shared.Args, reply *shared.
 			index = i
 		}
 	}
-	ver := file.Versions
-	version := ver[int(args.Chunknum)]
-	ver[int(args.Chunknum)] = version + 1
+	if file == nil {
+		return errors.New("Error because client doesn't have the file.")
+	}
+	// Versions count on from the latest, the client's own may be older
+	// A write made while disconnected only goes in on top of the version it was made against
+	version := d.FileVersions[args.Filename][args.Chunknum]
+	if args.Disconnected && args.Version != version {
+		reply.Writeable = true
+		reply.Conflict = true
+		reply.Version = version
+		return nil
+	}
+	ver := shared.CopyVersions(file.Versions)
+	ver[args.Chunknum] = version + 1
 
 	newFile := &shared.FileMetadata{
-		Name:     file.Name,
-		Versions: ver,
+		Name:      file.Name,
+		Versions:  ver,
+		ChunkSize: file.ChunkSize,
 	}
 	newFiles := files
 	newFiles[index] = newFile
@@ -240,19 +976,127 @@ func (d *DFSServerInstance) UpdateChunkVersion(args *shared.Args, reply *shared.
 		ID:        clientInfo.ID,
 		Addr:      clientInfo.Addr,
 		LocalPath: clientInfo.LocalPath,
+		UUID:      clientInfo.UUID,
 		Files:     newFiles,
 	}
 	d.ClientInfo[args.LocalPath] = newClient
 	d.ClientFiles[args.LocalPath] = newFiles
-	newVersions := d.FileVersions[args.Filename]
-	newVersions[int(args.Chunknum)] = version + 1
+	newVersions := shared.CopyVersions(d.FileVersions[args.Filename])
+	newVersions[args.Chunknum] = version + 1
 	d.FileVersions[args.Filename] = newVersions
 
+	err = d.logChanges([]string{args.Filename}, []string{args.LocalPath}, nil)
+	if err != nil {
+		return err
+	}
+
+	// A copy that can't be stored only means the chunk needs its holders online
+	if d.Store != nil && args.Data != nil {
+		d.Store.put(args.Filename, args.Chunknum, version+1, args.Data)
+	}
+	if d.Replicas > 0 && args.Data != nil {
+		d.queuePush(chunkPush{
+			filename: args.Filename,
+			chunkNum: args.Chunknum,
+			version:  version + 1,
+			data:     args.Data,
+		})
+	}
+
+	d.notifyWatchers(args.Filename, args.Chunknum, version+1, args.LocalPath)
+
+	reply.Writeable = true
 	reply.Version = version + 1
 	return nil
 }
 
+// Registers client LocalPath to be told about writes to Filename
+func (d *DFSServerInstance) Watch(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !contains(d.Watchers[args.Filename], args.LocalPath) {
+		d.Watchers[args.Filename] = append(d.Watchers[args.Filename], args.LocalPath)
+	}
+	return nil
+}
+
+// Stops telling client localPath about writes to any file
+func (d *DFSServerInstance) removeWatcher(localPath string) {
+	for filename, watchers := range d.Watchers {
+		var kept []string
+		for _, client := range watchers {
+			if client != localPath {
+				kept = append(kept, client)
+			}
+		}
+		if len(kept) == 0 {
+			delete(d.Watchers, filename)
+		} else {
+			d.Watchers[filename] = kept
+		}
+	}
+}
+
+// Moves the clients watching filename to newName, or stops them watching if newName is ""
+// Returns the clients that were watching filename
+func (d *DFSServerInstance) moveWatchers(filename string, newName string) []string {
+	watchers := d.Watchers[filename]
+	delete(d.Watchers, filename)
+	if newName != "" {
+		for _, client := range watchers {
+			if !contains(d.Watchers[newName], client) {
+				d.Watchers[newName] = append(d.Watchers[newName], client)
+			}
+		}
+	}
+	return watchers
+}
+
+// Tells connected clients watching a removed or renamed file so their watch follows it
+// Holders and skip are told already, a watcher that misses it watches the old name again when it mounts
+func (d *DFSServerInstance) tellWatchers(watchers []string, holders []string, skip string, change shared.NamespaceChange) {
+	for _, client := range watchers {
+		if client == skip || contains(holders, client) {
+			continue
+		}
+		d.mutex.RLock()
+		conn := d.Clients[client]
+		connected := d.ConnectedClients[client] == "Connected"
+		d.mutex.RUnlock()
+		if connected && conn != nil {
+			var reply shared.Reply
+			args := &shared.Args{
+				LocalPath: client,
+				Filename:  change.Filename,
+				NewName:   change.NewName,
+			}
+			conn.Call("ClientInstance.ApplyNamespaceChange", args, &reply)
+		}
+	}
+}
+
+// Tells connected clients watching filename that chunkNum is now at version
+// Calls are not waited for so a slow client doesn't hold up the writer
+func (d *DFSServerInstance) notifyWatchers(filename string, chunkNum uint32, version int, writer string) {
+	for _, client := range d.Watchers[filename] {
+		conn := d.Clients[client]
+		if d.ConnectedClients[client] != "Connected" || conn == nil {
+			continue
+		}
+		args := &shared.Args{
+			LocalPath: client,
+			Filename:  filename,
+			Chunknum:  chunkNum,
+			Version:   version,
+			Writer:    writer,
+		}
+		conn.Go("ClientInstance.NotifyChange", args, new(shared.Reply), nil)
+	}
+}
+
 func (d *DFSServerInstance) HeartbeatDisconnectExists(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 	_, exists := d.HeartbeatDisconnected[args.LocalPath]
 	if !exists {
 		reply.Exists = false
@@ -264,6 +1108,12 @@ func (d *DFSServerInstance) HeartbeatDisconnectExists(args *shared.Args, reply *
 
 // Returns true if client is connected
 func (d *DFSServerInstance) IsConnected(args *shared.Args, reply *shared.Reply) (err error) {
+	// Clients fail over to the backup once this primary's lease runs out
+	if d.replica.lapsed() {
+		return errLeaseLapsed
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 	client := args.LocalPath
 	if d.ConnectedClients[client] == "Connected" {
 		reply.Connected = true
@@ -275,111 +1125,100 @@ func (d *DFSServerInstance) IsConnected(args *shared.Args, reply *shared.Reply)
 
 // Adds a new file to server metadata at all the appropriate places
 func (d *DFSServerInstance) UpdateServer(args *shared.Args, reply *shared.Reply) (err error) {
+	defer d.awaitLogged(d.loggedCount(), &err)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.Directories[args.Filename] {
+		return errors.New("Error because a directory with that name exists.")
+	}
 	// Add file to client's metadata
 	clientMetadata := d.ClientInfo[args.LocalPath]
 
 	// Create file and add to file list
 	file := &shared.FileMetadata{
-		Name:     args.Filename,
-		Versions: args.Versions,
+		Name:      args.Filename,
+		Versions:  shared.CopyVersions(args.Versions),
+		ChunkSize: args.ChunkSize,
+	}
+	// A client that mounted again may tell us about a file we already know it has
+	var newFileList []*shared.FileMetadata
+	for _, f := range clientMetadata.Files {
+		if f.Name != args.Filename {
+			newFileList = append(newFileList, f)
+		}
 	}
-	newFileList := append(clientMetadata.Files, file)
+	newFileList = append(newFileList, file)
 
 	// Reassign mapping
 	updatedClientMetadata := &shared.ClientMetadata{
 		ID:        clientMetadata.ID,
 		Addr:      clientMetadata.Addr,
 		LocalPath: clientMetadata.LocalPath,
+		UUID:      clientMetadata.UUID,
 		Files:     newFileList,
 	}
 	d.ClientInfo[args.LocalPath] = updatedClientMetadata
 
 	// Update other Server metadata
 	d.ClientFiles[args.LocalPath] = newFileList
-	if len(d.FileVersions[args.Filename]) == 0 {
-		d.FileVersions[args.Filename] = file.Versions
+	if _, exists := d.FileVersions[args.Filename]; !exists {
+		d.FileVersions[args.Filename] = shared.CopyVersions(file.Versions)
+	}
+	if _, exists := d.ChunkSizes[args.Filename]; !exists {
+		d.ChunkSizes[args.Filename] = args.ChunkSize
 	}
 	if len(d.Files[args.Filename]) > 0 {
-		newList := append(d.Files[args.Filename], args.LocalPath)
+		newList := d.Files[args.Filename]
+		if !contains(newList, args.LocalPath) {
+			newList = append(newList, args.LocalPath)
+		}
 		d.Files[args.Filename] = newList
 	} else {
 		d.Files[args.Filename] = []string{args.LocalPath}
 	}
 
-	return nil
+	return d.logChanges([]string{args.Filename}, []string{args.LocalPath}, nil)
 }
 
 // Returns chunk of file read or error
 func (d *DFSServerInstance) Read(args *shared.Args, reply *shared.Reply) (err error) {
-	//Get latest version of chunk
-	versions := d.FileVersions[args.Filename]
-	chunkVersion := versions[int(args.Chunknum)]
+	defer d.awaitLogged(d.loggedCount(), &err)
+	if d.replica.lapsed() {
+		return errLeaseLapsed
+	}
+	winner, vers, rpcConnection, err := d.chunkSource(args)
+	storedData, storedVers, storeErr := d.storedChunk(args)
 
-	// Find client with chunk
-	var winner string
-	clients := d.Files[args.Filename]
-	var vers int
-	if args.Mode == int(READ) && !args.Open {
-		// Always has to return the latest version
-		for _, client := range clients {
-			if d.ConnectedClients[client] == "Connected" && client != args.LocalPath {
-				files := d.ClientFiles[client]
-				for _, file := range files {
-					if file.Name == args.Filename {
-						if file.Versions[int(args.Chunknum)] == chunkVersion {
-							winner = client
-							break
-						}
-					}
-				}
-			}
-		}
+	var data []byte
+	if storeErr == nil && (err != nil || storedVers >= vers) {
+		// The stored copy is as recent as any online client's
+		data = storedData
+		vers = storedVers
+	} else if err != nil {
+		return err
 	} else {
-		// Get available latest version
-		for vers = chunkVersion; vers >= 0; vers-- {
-			for _, client := range clients {
-				if d.ConnectedClients[client] == "Connected" {
-					files := d.ClientFiles[client]
-					for _, file := range files {
-						if file.Name == args.Filename {
-							if file.Versions[int(args.Chunknum)] == vers {
-								winner = client
-								break
-							}
-						}
-					}
-				}
-			}
+		var clientReply shared.Reply
+		clientArgs := &shared.Args{
+			Filename:    args.Filename,
+			LocalPath:   winner,
+			BytesToRead: args.BytesToRead,
+			Offset:      args.Offset,
 		}
-	}
 
-	if vers == 0 {
-		return errors.New("Error because no trivial chunks allowed.")
-	}
-
-	if winner == "" {
-		return errors.New("Error because no clients found.")
-	}
-
-	// Get chunk from client
-	host := d.ClientInfo[winner]
-
-	var clientReply shared.Reply
-	clientArgs := &shared.Args{
-		Filename:    args.Filename,
-		LocalPath:   host.LocalPath,
-		BytesToRead: args.BytesToRead,
-		Offset:      args.Offset,
-	}
-
-	rpcConnection, _ := d.Clients[args.LocalPath]
-	err = rpcConnection.Call("DFSServerInstance.GetChunk", clientArgs, &clientReply)
-	if err != nil {
-		return errors.New("Could not retrieve chunk from client")
+		err = rpcConnection.Call("ClientInstance.GetChunk", clientArgs, &clientReply)
+		if err != nil {
+			return errors.New("Could not retrieve chunk from client")
+		}
+		data = clientReply.Data
 	}
 
 	//Update server about file version client has
-	client := d.ClientInfo[args.LocalPath]
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	client, exists := d.ClientInfo[args.LocalPath]
+	if !exists {
+		return errors.New("Error because client is not mounted.")
+	}
 	files := client.Files
 	var f *shared.FileMetadata
 	var index int
@@ -390,11 +1229,15 @@ func (d *DFSServerInstance) Read(args *shared.Args, reply *shared.Reply) (err er
 			break
 		}
 	}
-	versions = f.Versions
-	versions[int(args.Chunknum)] = vers
+	if f == nil {
+		return errors.New("Error because client doesn't have the file.")
+	}
+	versions := shared.CopyVersions(f.Versions)
+	versions[args.Chunknum] = vers
 	file := &shared.FileMetadata{
-		Name:     f.Name,
-		Versions: versions,
+		Name:      f.Name,
+		Versions:  versions,
+		ChunkSize: f.ChunkSize,
 	}
 	copyFiles := files
 	copyFiles[index] = file
@@ -402,24 +1245,81 @@ func (d *DFSServerInstance) Read(args *shared.Args, reply *shared.Reply) (err er
 		ID:        client.ID,
 		Addr:      client.Addr,
 		LocalPath: client.LocalPath,
+		UUID:      client.UUID,
 		Files:     copyFiles,
 	}
 	d.ClientInfo[args.LocalPath] = newClient
 	d.ClientFiles[args.LocalPath] = copyFiles
+	err = d.logChanges(nil, []string{args.LocalPath}, nil)
+	if err != nil {
+		return err
+	}
 
 	// Return version read, chunk copied
-	reply.Chunk = clientReply.Chunk
+	reply.Data = data
 	reply.Version = vers
 	return nil
 }
 
+// Returns the client to fetch a chunk from for Read, the version it has and a connection to it
+func (d *DFSServerInstance) chunkSource(args *shared.Args) (winner string, vers int, conn *rpc.Client, err error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	//Get latest version of chunk
+	chunkVersion := d.FileVersions[args.Filename][args.Chunknum]
+
+	// Find client with chunk
+	if args.Mode == int(READ) && !args.Open {
+		// Always has to return the latest version
+		vers = chunkVersion
+		winner = d.clientWithVersion(args.Filename, args.Chunknum, vers, args.LocalPath)
+	} else {
+		// Get available latest version
+		for vers = chunkVersion; vers > 0; vers-- {
+			winner = d.clientWithVersion(args.Filename, args.Chunknum, vers, "")
+			if winner != "" {
+				break
+			}
+		}
+	}
+
+	if vers == 0 {
+		return "", 0, nil, errors.New("Error because no trivial chunks allowed.")
+	}
+
+	if winner == "" {
+		return "", 0, nil, errors.New("Error because no clients found.")
+	}
+
+	conn = d.Clients[winner]
+	if conn == nil {
+		return "", 0, nil, errors.New("Error because no clients found.")
+	}
+	return winner, vers, conn, nil
+}
+
 // Return version of chunks that client has
 // If client is in write mode, nobody else can open the file
+// Exists is false if the client hasn't told the server it has the file since mounting
 func (d *DFSServerInstance) Open(args *shared.Args, reply *shared.Reply) (err error) {
-	filesList := d.ClientFiles[args.LocalPath]
-	for _, file := range filesList {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.Directories[args.Filename] {
+		return errors.New("Error because a directory with that name exists.")
+	}
+	if isClientLog(args.Filename) {
+		return errors.New("Error because the name is reserved for client logs.")
+	}
+	clientInfo, exists := d.ClientInfo[args.LocalPath]
+	if !exists {
+		return nil
+	}
+	for _, file := range clientInfo.Files {
 		if file.Name == args.Filename {
-			reply.Versions = file.Versions
+			reply.Versions = shared.CopyVersions(file.Versions)
+			reply.ChunkSize = file.ChunkSize
+			reply.Exists = true
 		}
 
 	}
@@ -428,23 +1328,60 @@ func (d *DFSServerInstance) Open(args *shared.Args, reply *shared.Reply) (err er
 
 // Check latest version of file chunk
 func (d *DFSServerInstance) LatestVersion(args *shared.Args, reply *shared.Reply) (err error) {
-	versions := d.FileVersions[args.Filename]
-	chunkVersion := versions[int(args.Chunknum)]
-	reply.Version = chunkVersion
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	reply.Version = d.FileVersions[args.Filename][args.Chunknum]
+	return nil
+
+}
+
+// Returns what the server knows about a file: latest versions, chunk size,
+// versions each client holds and which client is writing to it
+func (d *DFSServerInstance) Stat(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	holders, exists := d.Files[args.Filename]
+	reply.Exists = exists
+	if !exists {
+		return nil
+	}
+	reply.Versions = shared.CopyVersions(d.FileVersions[args.Filename])
+	reply.ChunkSize = d.ChunkSizes[args.Filename]
+	reply.Writer = d.Access[args.Filename]
+	reply.Holders = make(map[string]map[uint32]int)
+	for _, client := range holders {
+		for _, file := range d.ClientFiles[client] {
+			if file.Name == args.Filename {
+				reply.Holders[client] = shared.CopyVersions(file.Versions)
+			}
+		}
+	}
 	return nil
+}
 
+// Return latest version of every chunk written in file
+func (d *DFSServerInstance) LatestVersions(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	reply.Versions = shared.CopyVersions(d.FileVersions[args.Filename])
+	return nil
 }
 
 // Return true if file exists in server
 func (d *DFSServerInstance) GlobalFileExists(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 	filename := args.Filename
 	_, exists := d.Files[filename]
 	reply.Exists = exists
+	reply.ChunkSize = d.ChunkSizes[filename]
 	return nil
 }
 
 // Return true if client with file exists otherwise false
 func (d *DFSServerInstance) ClientFilesOnline(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 	clients := d.Files[args.Filename]
 	exists := false
 	if len(clients) > 0 {
@@ -455,12 +1392,319 @@ func (d *DFSServerInstance) ClientFilesOnline(args *shared.Args, reply *shared.R
 			}
 		}
 	}
+	if !exists && d.Store != nil {
+		exists = d.storedLatest(args.Filename)
+	}
 	reply.Exists = exists
 	return nil
 }
 
+// Returns true if list contains s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a connected client other than skip holding version vers of chunk
+// Returns "" if there is none
+func (d *DFSServerInstance) clientWithVersion(filename string, chunkNum uint32, vers int, skip string) string {
+	for _, client := range d.Files[filename] {
+		if d.ConnectedClients[client] != "Connected" || client == skip {
+			continue
+		}
+		for _, file := range d.ClientFiles[client] {
+			if file.Name == filename && file.Versions[chunkNum] == vers {
+				return client
+			}
+		}
+	}
+	return ""
+}
+
+// Removes a file from the DFS and from every client's local path
+// Exists is false if there is no such file, Writeable is false if a client is writing to it
+func (d *DFSServerInstance) Remove(args *shared.Args, reply *shared.Reply) (err error) {
+	defer d.awaitLogged(d.loggedCount(), &err)
+	holders, watchers, err := d.remove(args, reply)
+	if err != nil || holders == nil {
+		return err
+	}
+	change := shared.NamespaceChange{Filename: args.Filename}
+	d.propagateChange(holders, args.LocalPath, change)
+	d.tellWatchers(watchers, holders, args.LocalPath, change)
+	return nil
+}
+
+// Removes a file from server metadata
+// Returns the clients holding it, nil if it wasn't removed, and the clients that were watching it
+func (d *DFSServerInstance) remove(args *shared.Args, reply *shared.Reply) (holders []string, watchers []string, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	holders, exists := d.Files[args.Filename]
+	reply.Exists = exists && !isClientLog(args.Filename)
+	if !reply.Exists {
+		return nil, nil, nil
+	}
+	reply.Writeable = !d.writeLocked(args.Filename)
+	if !reply.Writeable {
+		return nil, nil, nil
+	}
+
+	watchers = d.moveWatchers(args.Filename, "")
+	delete(d.Files, args.Filename)
+	delete(d.FileVersions, args.Filename)
+	delete(d.ChunkSizes, args.Filename)
+	for _, client := range holders {
+		d.renameClientFile(client, args.Filename, "")
+	}
+	if d.Store != nil {
+		d.Store.remove(args.Filename)
+	}
+	return holders, watchers, d.logChanges([]string{args.Filename}, holders, nil)
+}
+
+// Renames a file in the DFS and in every client's local path
+// Exists is false if there is no such file, Writeable is false if a client is writing to it,
+// Filename is set to the name that blocked the rename if the new name is taken or its directory doesn't exist
+func (d *DFSServerInstance) Rename(args *shared.Args, reply *shared.Reply) (err error) {
+	defer d.awaitLogged(d.loggedCount(), &err)
+	holders, watchers, err := d.rename(args, reply)
+	if err != nil || holders == nil {
+		return err
+	}
+	change := shared.NamespaceChange{Filename: args.Filename, NewName: args.NewName}
+	d.propagateChange(holders, args.LocalPath, change)
+	d.tellWatchers(watchers, holders, args.LocalPath, change)
+	return nil
+}
+
+// Renames a file in server metadata
+// Returns the clients holding it, nil if it wasn't renamed, and the clients that were watching it
+func (d *DFSServerInstance) rename(args *shared.Args, reply *shared.Reply) (holders []string, watchers []string, err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	holders, exists := d.Files[args.Filename]
+	reply.Exists = exists && !isClientLog(args.Filename)
+	if !reply.Exists {
+		return nil, nil, nil
+	}
+	reply.Writeable = !d.writeLocked(args.Filename)
+	if !reply.Writeable {
+		return nil, nil, nil
+	}
+	if _, taken := d.Files[args.NewName]; taken || d.Directories[args.NewName] || isClientLog(args.NewName) {
+		reply.Filename = args.NewName
+		return nil, nil, nil
+	}
+	if !d.directoryExists(parentDir(args.NewName)) {
+		reply.Filename = parentDir(args.NewName)
+		return nil, nil, nil
+	}
+
+	watchers = d.moveWatchers(args.Filename, args.NewName)
+	d.Files[args.NewName] = holders
+	delete(d.Files, args.Filename)
+	d.FileVersions[args.NewName] = d.FileVersions[args.Filename]
+	delete(d.FileVersions, args.Filename)
+	d.ChunkSizes[args.NewName] = d.ChunkSizes[args.Filename]
+	delete(d.ChunkSizes, args.Filename)
+	for _, client := range holders {
+		d.renameClientFile(client, args.Filename, args.NewName)
+	}
+	if d.Store != nil {
+		d.Store.rename(args.Filename, args.NewName)
+	}
+	return holders, watchers, d.logChanges([]string{args.Filename, args.NewName}, holders, nil)
+}
+
+// Renames a file in a client's file list, removes it if newName is ""
+func (d *DFSServerInstance) renameClientFile(localPath string, filename string, newName string) {
+	clientInfo, exists := d.ClientInfo[localPath]
+	if !exists {
+		return
+	}
+	var newFiles []*shared.FileMetadata
+	for _, file := range clientInfo.Files {
+		if file.Name != filename {
+			newFiles = append(newFiles, file)
+		} else if newName != "" {
+			newFiles = append(newFiles, &shared.FileMetadata{
+				Name:      newName,
+				Versions:  file.Versions,
+				ChunkSize: file.ChunkSize,
+			})
+		}
+	}
+	d.ClientInfo[localPath] = &shared.ClientMetadata{
+		ID:        clientInfo.ID,
+		Addr:      clientInfo.Addr,
+		LocalPath: clientInfo.LocalPath,
+		UUID:      clientInfo.UUID,
+		Files:     newFiles,
+	}
+	d.ClientFiles[localPath] = newFiles
+}
+
+// Tells every client in holders except skip to apply change to its local path
+// Clients that can't be reached get the change on their next mount
+// Must be called without holding mutex
+func (d *DFSServerInstance) propagateChange(holders []string, skip string, change shared.NamespaceChange) {
+	for _, client := range holders {
+		if client == skip {
+			continue
+		}
+		d.mutex.RLock()
+		conn := d.Clients[client]
+		connected := d.ConnectedClients[client] == "Connected"
+		d.mutex.RUnlock()
+		if connected && conn != nil {
+			var reply shared.Reply
+			args := &shared.Args{
+				LocalPath: client,
+				Filename:  change.Filename,
+				NewName:   change.NewName,
+			}
+			err := conn.Call("ClientInstance.ApplyNamespaceChange", args, &reply)
+			if err == nil {
+				continue
+			}
+		}
+		d.mutex.Lock()
+		d.PendingChanges[client] = append(d.PendingChanges[client], change)
+		d.logChanges(nil, []string{client}, nil)
+		d.mutex.Unlock()
+	}
+}
+
+// Lists files in the DFS starting with Prefix, sorted by name
+// Returns at most Limit names (all if Limit <= 0) that come after After
+func (d *DFSServerInstance) ListFiles(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	var names []string
+	for name := range d.Files {
+		if isClientLog(name) {
+			continue
+		}
+		if strings.HasPrefix(name, args.Prefix) && name > args.After {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if args.Limit > 0 && len(names) > args.Limit {
+		names = names[:args.Limit]
+	}
+	reply.Names = names
+	return nil
+}
+
+// Returns true if name is the file every client registers for its log, it isn't a user file
+func isClientLog(name string) bool {
+	return name == "log"
+}
+
+// Returns the directory containing a file or directory, "" for the root
+func parentDir(name string) string {
+	dir := path.Dir(name)
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return dir
+}
+
+// Returns true if directory exists
+func (d *DFSServerInstance) directoryExists(dir string) bool {
+	return dir == "" || d.Directories[dir]
+}
+
+// Return true if directory exists in server
+func (d *DFSServerInstance) DirectoryExists(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	reply.Exists = d.directoryExists(args.Filename)
+	return nil
+}
+
+// Creates a directory
+// Exists is false if the parent directory doesn't exist
+func (d *DFSServerInstance) Mkdir(args *shared.Args, reply *shared.Reply) (err error) {
+	defer d.awaitLogged(d.loggedCount(), &err)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.directoryExists(parentDir(args.Filename)) {
+		reply.Exists = false
+		return nil
+	}
+	if _, exists := d.Files[args.Filename]; exists {
+		return errors.New("Error because a file with that name exists.")
+	}
+	d.Directories[args.Filename] = true
+	reply.Exists = true
+	return d.logChanges(nil, nil, []string{args.Filename})
+}
+
+// Removes an empty directory
+// Exists is false if the directory doesn't exist, Entries is set if it isn't empty
+func (d *DFSServerInstance) Rmdir(args *shared.Args, reply *shared.Reply) (err error) {
+	defer d.awaitLogged(d.loggedCount(), &err)
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if args.Filename == "" || !d.Directories[args.Filename] {
+		reply.Exists = false
+		return nil
+	}
+	reply.Exists = true
+	reply.Entries = d.readDir(args.Filename)
+	if len(reply.Entries) == 0 {
+		delete(d.Directories, args.Filename)
+		return d.logChanges(nil, nil, []string{args.Filename})
+	}
+	return nil
+}
+
+// Lists the files and directories directly inside a directory
+// Exists is false if the directory doesn't exist
+func (d *DFSServerInstance) ReadDir(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	reply.Exists = d.directoryExists(args.Filename)
+	if reply.Exists {
+		reply.Entries = d.readDir(args.Filename)
+	}
+	return nil
+}
+
+// Returns the entries of a directory sorted by name
+func (d *DFSServerInstance) readDir(dir string) []shared.DirEntry {
+	var entries []shared.DirEntry
+	for name := range d.Directories {
+		if parentDir(name) == dir {
+			entries = append(entries, shared.DirEntry{Name: path.Base(name), IsDir: true})
+		}
+	}
+	for name := range d.Files {
+		if parentDir(name) == dir && !isClientLog(name) {
+			entries = append(entries, shared.DirEntry{Name: path.Base(name), IsDir: false})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries
+}
+
 func (d *DFSServerInstance) UMountDFS(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
 	d.ConnectedClients[args.LocalPath] = "Disconnected"
+	delete(d.HeartbeatReceived, args.LocalPath)
+	d.removeWatcher(args.LocalPath)
 	if d.ConnectedClients[args.LocalPath] == "Connected" {
 		d.HeartbeatServer.Close()
 		client := d.Clients[args.LocalPath]
@@ -469,3 +1713,1395 @@ func (d *DFSServerInstance) UMountDFS(args *shared.Args, reply *shared.Reply) (e
 	}
 	return nil
 }
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <PERSISTENCE>
+
+// Metadata of one file as saved in the log
+type fileState struct {
+	Name      string
+	Exists    bool           // False if the file was removed
+	Holders   []string       // Clients with a copy of the file
+	Versions  map[uint32]int // Latest version of each chunk written
+	ChunkSize int            // Bytes per chunk
+	Writer    string         // Client with write access, "" if none
+	Opens     int            // Opens of the writer sharing its write lease
+	Epoch     int            // Epoch of the latest write lease
+	Locks     []*chunkLock   // Chunk locks held on the file
+}
+
+// Metadata of one client as saved in the log
+type clientState struct {
+	LocalPath string
+	Info      *shared.ClientMetadata   // nil if the client never mounted
+	Files     []*shared.FileMetadata   // Files the client has a copy of
+	Writing   string                   // File the client has write access to
+	Pending   []shared.NamespaceChange // Removals/renames to apply on its next mount
+}
+
+// Metadata of one directory as saved in the log
+type dirState struct {
+	Name   string
+	Exists bool // False if the directory was removed
+}
+
+// Entry of the write-ahead log holding the new state of everything a call changed
+// A snapshot is a single record holding the state of everything
+type logRecord struct {
+	Count   int
+	Files   []fileState
+	Clients []clientState
+	Dirs    []dirState
+}
+
+// Returns the current metadata of a file
+func (d *DFSServerInstance) fileState(name string) fileState {
+	holders, exists := d.Files[name]
+	return fileState{
+		Name:      name,
+		Exists:    exists,
+		Holders:   holders,
+		Versions:  d.FileVersions[name],
+		ChunkSize: d.ChunkSizes[name],
+		Writer:    d.Access[name],
+		Opens:     d.LeaseOpens[name],
+		Epoch:     d.LeaseEpochs[name],
+		Locks:     d.ChunkLocks[name],
+	}
+}
+
+// Returns the current metadata of a client
+func (d *DFSServerInstance) clientState(localPath string) clientState {
+	return clientState{
+		LocalPath: localPath,
+		Info:      d.ClientInfo[localPath],
+		Files:     d.ClientFiles[localPath],
+		Writing:   d.ClientsWriting[localPath],
+		Pending:   d.PendingChanges[localPath],
+	}
+}
+
+// Sets metadata to the state held in a log record
+func (d *DFSServerInstance) apply(rec *logRecord) {
+	if rec.Count > d.Count {
+		d.Count = rec.Count
+	}
+	for _, file := range rec.Files {
+		if file.Epoch > d.LeaseEpochs[file.Name] {
+			d.LeaseEpochs[file.Name] = file.Epoch
+		}
+		if len(file.Locks) > 0 {
+			d.ChunkLocks[file.Name] = file.Locks
+		} else {
+			delete(d.ChunkLocks, file.Name)
+		}
+		// Write access can be granted before a new file is created
+		if file.Writer != "" {
+			d.Access[file.Name] = file.Writer
+			d.LeaseOpens[file.Name] = file.Opens
+		} else {
+			delete(d.Access, file.Name)
+			delete(d.LeaseOpens, file.Name)
+		}
+		if !file.Exists {
+			delete(d.Files, file.Name)
+			delete(d.FileVersions, file.Name)
+			delete(d.ChunkSizes, file.Name)
+			continue
+		}
+		d.Files[file.Name] = file.Holders
+		d.FileVersions[file.Name] = shared.CopyVersions(file.Versions)
+		d.ChunkSizes[file.Name] = file.ChunkSize
+	}
+	for _, client := range rec.Clients {
+		if client.Info != nil {
+			d.ClientInfo[client.LocalPath] = client.Info
+		} else {
+			delete(d.ClientInfo, client.LocalPath)
+		}
+		if client.Files != nil {
+			d.ClientFiles[client.LocalPath] = client.Files
+		} else {
+			delete(d.ClientFiles, client.LocalPath)
+		}
+		if client.Writing != "" {
+			d.ClientsWriting[client.LocalPath] = client.Writing
+		} else {
+			delete(d.ClientsWriting, client.LocalPath)
+		}
+		if len(client.Pending) > 0 {
+			d.PendingChanges[client.LocalPath] = client.Pending
+		} else {
+			delete(d.PendingChanges, client.LocalPath)
+		}
+	}
+	for _, dir := range rec.Dirs {
+		if dir.Exists {
+			d.Directories[dir.Name] = true
+		} else {
+			delete(d.Directories, dir.Name)
+		}
+	}
+}
+
+// Appends the current metadata of files, clients and dirs to the log and syncs it
+// Must be called after every change to persisted metadata and before replying
+// Handlers that log wait for the backup with awaitLogged, deferred before they take mutex
+func (d *DFSServerInstance) logChanges(files []string, clients []string, dirs []string) error {
+	d.logMutex.Lock()
+	defer d.logMutex.Unlock()
+	if d.Log == nil && d.Raft == nil {
+		return nil
+	}
+
+	rec := &logRecord{Count: d.Count}
+	for _, name := range files {
+		rec.Files = append(rec.Files, d.fileState(name))
+	}
+	for _, localPath := range clients {
+		if localPath != "" {
+			rec.Clients = append(rec.Clients, d.clientState(localPath))
+		}
+	}
+	for _, dir := range dirs {
+		rec.Dirs = append(rec.Dirs, dirState{Name: dir, Exists: d.Directories[dir]})
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if d.Raft != nil {
+		return d.propose(data)
+	}
+	if d.replica.lapsed() {
+		// The backup may have taken over, the change must not be kept
+		d.reload()
+		return errLeaseLapsed
+	}
+	err = d.writeRecord(data)
+	if err != nil {
+		// The change is already made, undo it by loading the metadata saved before it
+		d.reload()
+		return err
+	}
+	d.logged++
+	d.replicate(data)
+	return nil
+}
+
+// Returns the number of records logged since the server started
+func (d *DFSServerInstance) loggedCount() int {
+	d.logMutex.Lock()
+	defer d.logMutex.Unlock()
+	return d.logged
+}
+
+// Waits until the backup copied the changes a handler logged, or the raft group committed them,
+// so they outlast a failover. Sets err if the group didn't commit them in time
+// Deferred before the handler takes mutex so other calls go on meanwhile,
+// count is what loggedCount returned when the handler started
+func (d *DFSServerInstance) awaitLogged(count int, err *error) {
+	d.logMutex.Lock()
+	logged, index, term := d.logged, d.proposedIndex, d.proposedTerm
+	d.logMutex.Unlock()
+	if *err != nil || logged == count {
+		return
+	}
+	if d.Raft == nil {
+		d.replica.await()
+		return
+	}
+
+	// Entries commit in order, so ours are committed once the latest one is
+	*err = d.Raft.WaitCommitted(index, term, commitTimeout)
+	if *err != nil {
+		// The changes may never be committed, rebuild the metadata from what was
+		// They are applied again if they are committed after all
+		d.Raft.Reapply()
+	}
+}
+
+// Appends an encoded record to the log and syncs it, must hold logMutex
+// A record that can't be written is cut from the log so the records after it can be replayed
+func (d *DFSServerInstance) writeRecord(data []byte) error {
+	offset, err := d.Log.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = d.Log.Write(data)
+	}
+	if err == nil {
+		err = d.Log.Sync()
+	}
+	if err != nil {
+		d.Log.Truncate(offset)
+		d.Log.Seek(offset, io.SeekStart)
+		return errors.New("Could not write to the metadata log")
+	}
+
+	d.LogRecords++
+	if d.LogRecords >= snapshotInterval {
+		// The record is saved already, a failed snapshot is tried again after the next one
+		err = d.snapshot()
+		if err != nil && d.Log == nil {
+			log.Fatal("Could not start a new metadata log: ", err)
+		}
+	}
+	return nil
+}
+
+// Returns a record holding all metadata
+func (d *DFSServerInstance) state() *logRecord {
+	rec := &logRecord{Count: d.Count}
+	for name := range d.Files {
+		rec.Files = append(rec.Files, d.fileState(name))
+	}
+	for name := range d.Access {
+		if _, exists := d.Files[name]; !exists {
+			rec.Files = append(rec.Files, d.fileState(name))
+		}
+	}
+	for name := range d.ChunkLocks {
+		if _, exists := d.Files[name]; !exists && len(d.Access[name]) == 0 {
+			rec.Files = append(rec.Files, d.fileState(name))
+		}
+	}
+	clients := make(map[string]bool)
+	for localPath := range d.ClientInfo {
+		clients[localPath] = true
+	}
+	for localPath := range d.ClientFiles {
+		clients[localPath] = true
+	}
+	for localPath := range d.PendingChanges {
+		clients[localPath] = true
+	}
+	for localPath := range clients {
+		rec.Clients = append(rec.Clients, d.clientState(localPath))
+	}
+	for dir := range d.Directories {
+		rec.Dirs = append(rec.Dirs, dirState{Name: dir, Exists: true})
+	}
+	return rec
+}
+
+// Saves all metadata to a new snapshot and starts an empty log
+// A crash before the log is emptied is harmless, replaying it on the snapshot leaves the same state
+func (d *DFSServerInstance) snapshot() error {
+	data, err := json.Marshal(d.state())
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a partial snapshot
+	snapshotPath := filepath.Join(d.DataDir, snapshotFile)
+	tmp, err := os.Create(snapshotPath + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(snapshotPath+".tmp", snapshotPath)
+	if err != nil {
+		return err
+	}
+	if dir, err := os.Open(d.DataDir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	// Start a new log
+	if d.Log != nil {
+		d.Log.Close()
+	}
+	d.Log, err = os.OpenFile(filepath.Join(d.DataDir, logFile), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		d.Log = nil
+		return err
+	}
+	d.LogRecords = 0
+	return nil
+}
+
+// Loads the snapshot in dataDir and replays the log written after it
+// No client is connected after recovery, write leases held before are kept
+// until their client mounts again or recoveredGrantTimeout passes
+func (d *DFSServerInstance) Recover(dataDir string) error {
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return err
+	}
+	d.DataDir = dataDir
+	err = d.load()
+	if err != nil {
+		return err
+	}
+
+	// A backup that followed this server before may have taken over since,
+	// clients are only served once it follows again
+	if _, err := os.Stat(filepath.Join(dataDir, backupFile)); err == nil {
+		d.replica.mutex.Lock()
+		d.replica.leased = true
+		d.replica.mutex.Unlock()
+	}
+
+	d.holdRecoveredGrants()
+	return d.snapshot()
+}
+
+// Applies the snapshot in the data directory and the log written after it
+func (d *DFSServerInstance) load() error {
+	data, err := ioutil.ReadFile(filepath.Join(d.DataDir, snapshotFile))
+	if err == nil {
+		var rec logRecord
+		err = json.Unmarshal(data, &rec)
+		if err != nil {
+			return err
+		}
+		d.apply(&rec)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	walFile, err := os.Open(filepath.Join(d.DataDir, logFile))
+	if err == nil {
+		decoder := json.NewDecoder(walFile)
+		for {
+			var rec logRecord
+			// Stop at the end of the log or at a record cut short by a crash
+			if decoder.Decode(&rec) != nil {
+				break
+			}
+			d.apply(&rec)
+		}
+		walFile.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Sets metadata back to what was last saved, undoing changes that couldn't be logged
+// Must hold the write lock and logMutex
+func (d *DFSServerInstance) reload() {
+	held := d.ChunkLocks
+	d.resetMetadata()
+	err := d.load()
+	if err != nil {
+		log.Fatal("Could not reload server metadata: ", err)
+	}
+
+	// Locks that were held keep running out when they would have
+	for filename, locks := range d.ChunkLocks {
+		for _, lock := range locks {
+			for _, h := range held[filename] {
+				if h.LocalPath == lock.LocalPath && h.First == lock.First && h.Last == lock.Last && h.Epoch == lock.Epoch {
+					lock.expiry = h.expiry
+				}
+			}
+		}
+	}
+}
+
+// Clients writing before a restart or failover may not know the server went away
+// They can't renew their leases, so other clients may write once these run out
+func (d *DFSServerInstance) holdRecoveredGrants() {
+	for filename := range d.Access {
+		d.LeaseExpiry[filename] = time.Now().Add(recoveredGrantTimeout)
+	}
+	for _, locks := range d.ChunkLocks {
+		for _, lock := range locks {
+			lock.expiry = time.Now().Add(recoveredGrantTimeout)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <REPLICATION>
+
+// Log records the primary keeps until its backup has copied them
+type replication struct {
+	mutex   sync.Mutex
+	backup  string        // Address of the backup, "" if none registered
+	records [][]byte      // Encoded records the backup hasn't copied yet
+	first   int           // Sequence number of records[0]
+	copied  chan struct{} // Closed and replaced when the backup copies records
+	added   chan struct{} // Closed and replaced when a record is added or the backup changes
+	lagging bool          // The backup fell behind, replies don't wait for it until it catches up
+
+	// Lease fencing the primary off once its backup may have taken over
+	leased   bool      // A backup registered, clients are only served while it keeps following
+	followed time.Time // When the backup last asked for records, the lease runs out primaryLease after
+}
+
+// Error of calls refused by a primary whose backup stopped following
+var errLeaseLapsed = errors.New("Error because the backup stopped following and may have taken over.")
+
+func newReplication(backup string) *replication {
+	return &replication{
+		backup: backup,
+		copied: make(chan struct{}),
+		added:  make(chan struct{}),
+	}
+}
+
+// Starts replicating to backup from sequence number 0, "" stops replicating
+func (r *replication) reset(backup string) {
+	r.backup = backup
+	r.records = nil
+	r.first = 0
+	r.lagging = false
+	close(r.added)
+	r.added = make(chan struct{})
+}
+
+// Returns true if a backup registered and hasn't asked for records within primaryLease
+// The backup may have taken over then, so the primary must not serve clients
+func (r *replication) lapsed() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.leased && time.Since(r.followed) > primaryLease
+}
+
+// Returns the addresses of this server and its backup
+func (d *DFSServerInstance) servers() []string {
+	servers := []string{d.Addr}
+	d.replica.mutex.Lock()
+	defer d.replica.mutex.Unlock()
+	if d.replica.backup != "" {
+		servers = append(servers, d.replica.backup)
+	}
+	return servers
+}
+
+// Tells connected clients which servers to mount on if this one fails
+func (d *DFSServerInstance) announceServers() {
+	servers := d.servers()
+	for client, conn := range d.Clients {
+		if d.ConnectedClients[client] != "Connected" || conn == nil {
+			continue
+		}
+		args := &shared.Args{LocalPath: client, Servers: servers}
+		conn.Go("ClientInstance.UpdateServers", args, new(shared.Reply), nil)
+	}
+}
+
+// Keeps an encoded log record for the backup, replies wait for it to be copied with awaitLogged
+// A backup that falls too far behind is dropped and copies all metadata again when it next asks for records
+func (d *DFSServerInstance) replicate(data []byte) {
+	r := d.replica
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.backup == "" {
+		return
+	}
+	r.records = append(r.records, data)
+	close(r.added)
+	r.added = make(chan struct{})
+	if r.lagging && len(r.records) > snapshotInterval {
+		r.reset("")
+	}
+}
+
+// Waits until the backup copies every log record kept so far
+// Replies don't wait for a backup that fell behind
+func (r *replication) await() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	seq := r.first + len(r.records)
+	timeout := time.After(replicationTimeout)
+	for !r.lagging && r.first < seq && r.backup != "" {
+		copied := r.copied
+		r.mutex.Unlock()
+		select {
+		case <-copied:
+			r.mutex.Lock()
+		case <-timeout:
+			r.mutex.Lock()
+			r.lagging = true
+		}
+	}
+}
+
+// Makes the server at args.Addr the backup and replies with all metadata
+// Log records written from now on are kept until the backup copies them with FollowLog
+func (d *DFSServerInstance) RegisterBackup(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	reply.Data, err = json.Marshal(d.state())
+	if err != nil {
+		return err
+	}
+	// Remember there is a backup so clients aren't served after a restart until it follows again
+	err = d.saveBackup(args.Addr)
+	if err != nil {
+		return err
+	}
+	d.replica.mutex.Lock()
+	d.replica.reset(args.Addr)
+	d.replica.leased = true
+	d.replica.followed = time.Now()
+	d.replica.mutex.Unlock()
+	d.announceServers()
+	return nil
+}
+
+// Saves the address of the backup in the data directory
+func (d *DFSServerInstance) saveBackup(addr string) error {
+	file, err := os.Create(filepath.Join(d.DataDir, backupFile))
+	if err != nil {
+		return err
+	}
+	_, err = file.Write([]byte(addr))
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	return err
+}
+
+// Replies with the log records from sequence number args.Version on, waiting up to
+// followTimeout for one to be written so the call doubles as a ping of the primary
+// Records before args.Version have been copied by the backup and are dropped
+// Each call from the backup renews the primary's lease
+func (d *DFSServerInstance) FollowLog(args *shared.Args, reply *shared.Reply) (err error) {
+	r := d.replica
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if args.Addr != r.backup {
+		return errors.New("Not the backup of this server")
+	}
+	r.followed = time.Now()
+	if copied := args.Version - r.first; copied > 0 {
+		if copied > len(r.records) {
+			copied = len(r.records)
+		}
+		r.records = r.records[copied:]
+		r.first += copied
+		close(r.copied)
+		r.copied = make(chan struct{})
+	}
+	if len(r.records) == 0 {
+		r.lagging = false
+		added := r.added
+		r.mutex.Unlock()
+		select {
+		case <-added:
+		case <-time.After(followTimeout):
+		}
+		r.mutex.Lock()
+		if args.Addr != r.backup {
+			return errors.New("Not the backup of this server")
+		}
+		r.followed = time.Now()
+	}
+	reply.Version = r.first
+	reply.Data = bytes.Join(r.records, nil)
+	return nil
+}
+
+// Copies the primary's metadata into this server's until the primary stops answering
+// Waits for the primary as long as it takes until it has copied its metadata once,
+// then until the primary's lease has surely run out
+func (d *DFSServerInstance) followPrimary(primary string) {
+	var conn *rpc.Client
+	next := -1 // Sequence number of the next record to copy, -1 to copy all metadata
+	registered := false
+	var answered time.Time // When the primary last answered, its lease ran from before then
+	for failures := 0; failures < followFailures || time.Since(answered) < 2*primaryLease; {
+		if conn == nil {
+			c, err := net.DialTimeout("tcp", primary, followTimeout)
+			if err != nil {
+				if registered {
+					failures++
+				}
+				time.Sleep(followTimeout)
+				continue
+			}
+			conn = rpc.NewClient(c)
+		}
+
+		method := "DFSServerInstance.FollowLog"
+		if next < 0 {
+			method = "DFSServerInstance.RegisterBackup"
+		}
+		var reply shared.Reply
+		call := conn.Go(method, &shared.Args{Addr: d.Addr, Version: next}, &reply, make(chan *rpc.Call, 1))
+		var err error
+		select {
+		case <-call.Done:
+			err = call.Error
+		case <-time.After(followTimeout + replicationTimeout):
+			err = errors.New("Primary did not answer")
+		}
+		_, refused := err.(rpc.ServerError)
+		if err == nil || refused {
+			answered = time.Now()
+		}
+		if refused {
+			// The primary restarted or dropped this backup, copy everything again
+			next = -1
+			continue
+		}
+		if err != nil {
+			if registered {
+				failures++
+			}
+			conn.Close()
+			conn = nil
+			continue
+		}
+
+		failures = 0
+		if next < 0 {
+			next, err = d.copyState(reply.Data)
+			registered = true
+		} else {
+			next, err = d.copyRecords(reply.Version, reply.Data)
+		}
+		if err != nil {
+			log.Fatal("Could not copy metadata from the primary: ", err)
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Replaces all metadata with the encoded state of the primary and saves it in a snapshot
+// Returns the sequence number of the first log record to copy next
+func (d *DFSServerInstance) copyState(data []byte) (int, error) {
+	var rec logRecord
+	err := json.Unmarshal(data, &rec)
+	if err != nil {
+		return -1, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.logMutex.Lock()
+	defer d.logMutex.Unlock()
+	d.resetMetadata()
+	d.apply(&rec)
+	return 0, d.snapshot()
+}
+
+// Applies the primary's encoded log records starting at sequence number first and logs them
+// Returns the sequence number of the log record to copy next
+func (d *DFSServerInstance) copyRecords(first int, data []byte) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.logMutex.Lock()
+	defer d.logMutex.Unlock()
+	next := first
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var rec logRecord
+		err := json.Unmarshal(line, &rec)
+		if err != nil {
+			return next, err
+		}
+		d.apply(&rec)
+		err = d.writeRecord(line)
+		if err != nil {
+			return next, err
+		}
+		next++
+	}
+	return next, nil
+}
+
+// Forgets all persisted metadata, lease epochs are kept so they never go down
+func (d *DFSServerInstance) resetMetadata() {
+	d.ClientInfo = make(map[string]*shared.ClientMetadata)
+	d.Access = make(map[string]string)
+	d.LeaseOpens = make(map[string]int)
+	d.ClientFiles = make(map[string][]*shared.FileMetadata)
+	d.FileVersions = make(map[string]map[uint32]int)
+	d.ChunkSizes = make(map[string]int)
+	d.Files = make(map[string][]string)
+	d.Directories = make(map[string]bool)
+	d.PendingChanges = make(map[string][]shared.NamespaceChange)
+	d.ClientsWriting = make(map[string]string)
+	d.ChunkLocks = make(map[string][]*chunkLock)
+}
+
+// Starts serving clients in place of the failed primary
+// No client is mounted here yet, write leases are kept for their clients like after a restart
+func (d *DFSServerInstance) takeOver() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.replica.mutex.Lock()
+	d.replica.leased = false
+	d.replica.mutex.Unlock()
+	os.Remove(filepath.Join(d.DataDir, backupFile))
+	d.holdRecoveredGrants()
+	log.Printf("Primary failed, serving clients at %s", d.Addr)
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <RAFT>
+
+// Appends an encoded log record to the raft log, awaitLogged waits until a majority of the group has it
+// The change it records is already made, so it isn't applied again when committed
+// Must hold the write lock and logMutex
+func (d *DFSServerInstance) propose(data []byte) error {
+	index, term, err := d.Raft.Propose(data)
+	if err != nil {
+		// The change was made by a call still running after we stopped leading, undo it
+		d.Raft.Reapply()
+		return err
+	}
+	d.proposed[index] = term
+	d.proposedIndex = index
+	d.proposedTerm = term
+	d.logged++
+	return nil
+}
+
+// Applies a committed raft entry to the metadata, a snapshot replaces all of it
+func (d *DFSServerInstance) applyCommitted(msg raft.ApplyMsg) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if msg.Snapshot {
+		// Changes proposed before are undone and applied again if they are committed
+		d.proposed = make(map[int]int)
+		d.resetMetadata()
+		if msg.Data != nil {
+			var rec logRecord
+			err := json.Unmarshal(msg.Data, &rec)
+			if err != nil {
+				log.Fatal("Could not read raft snapshot: ", err)
+			}
+			d.apply(&rec)
+		}
+		d.LogRecords = 0
+		return
+	}
+
+	term, proposed := d.proposed[msg.Index]
+	delete(d.proposed, msg.Index)
+	if msg.Data == nil {
+		// A leader's first entry, every entry before it is applied
+		d.readyTerm = msg.Term
+	} else if !proposed || term != msg.Term {
+		var rec logRecord
+		err := json.Unmarshal(msg.Data, &rec)
+		if err != nil {
+			log.Fatal("Could not read raft log entry: ", err)
+		}
+		d.apply(&rec)
+	}
+
+	// Fold the log into a snapshot while no change of ours is waiting to be committed
+	// Later committed changes may be in it already, applying them again leaves the same state
+	d.LogRecords++
+	if d.LogRecords >= snapshotInterval && len(d.proposed) == 0 {
+		data, err := json.Marshal(d.state())
+		if err == nil && d.Raft.Snapshot(msg.Index, data) == nil {
+			d.LogRecords = 0
+		}
+	}
+}
+
+// Serves clients whenever this server leads the raft group, never returns
+func (d *DFSServerInstance) lead() {
+	for {
+		term := d.waitLeading()
+		d.mutex.Lock()
+		d.holdRecoveredGrants()
+		d.mutex.Unlock()
+		log.Printf("Leading term %d, serving clients at %s", term, d.Addr)
+
+		stop := make(chan struct{})
+		go func() {
+			for d.Raft.Leading(term) {
+				time.Sleep(leaderCheckInterval)
+			}
+			close(stop)
+		}()
+		err := d.serveClients(stop)
+		if err != nil {
+			log.Fatal("Listening error occurred: ", err)
+		}
+		d.stepDown()
+		log.Printf("Lost leadership of term %d, stopped serving clients", term)
+	}
+}
+
+// Waits until this server leads the group and has applied every entry before its term
+// Returns the term
+func (d *DFSServerInstance) waitLeading() int {
+	for {
+		d.mutex.RLock()
+		term := d.readyTerm
+		d.mutex.RUnlock()
+		if term > 0 && d.Raft.Leading(term) {
+			return term
+		}
+		time.Sleep(leaderCheckInterval)
+	}
+}
+
+// Forgets connected clients and rebuilds the metadata from the raft log
+// Changes made while leading may never be committed, the new leader's log decides
+func (d *DFSServerInstance) stepDown() {
+	d.mutex.Lock()
+	for filename := range d.WriteQueue {
+		d.dropWaiters(filename, func(w *writeWaiter) bool { return true })
+	}
+	for _, conn := range d.Clients {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	d.ConnectedClients = make(map[string]string)
+	d.Clients = make(map[string]*rpc.Client)
+	d.Heartbeat = make(map[string]time.Time)
+	d.HeartbeatDisconnected = make(map[string]bool)
+	d.Watchers = make(map[string][]string)
+	d.LeaseExpiry = make(map[string]time.Time)
+	d.proposed = make(map[int]int)
+	d.readyTerm = 0
+	d.mutex.Unlock()
+	d.Raft.Reapply()
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <CHUNK STORE>
+
+// Copies of the latest chunk versions kept on the server's disk,
+// so files can be read while every client holding them is offline
+type chunkStore struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+// Chunk version as saved in the store
+type storedChunk struct {
+	Version int
+	Data    []byte
+}
+
+func newChunkStore(dir string) (*chunkStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkStore{dir: dir}, nil
+}
+
+// Returns the directory holding the chunks of filename
+// Names are hex encoded so files in directories don't need them in the store
+func (s *chunkStore) fileDir(filename string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(filename)))
+}
+
+// Returns the path of a chunk in the store
+func (s *chunkStore) chunkPath(filename string, chunkNum uint32) string {
+	return filepath.Join(s.fileDir(filename), strconv.FormatUint(uint64(chunkNum), 10))
+}
+
+// Returns the stored version of a chunk and its data, version 0 if none is stored
+func (s *chunkStore) get(filename string, chunkNum uint32) (version int, data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	chunk := s.load(filename, chunkNum)
+	return chunk.Version, chunk.Data
+}
+
+// Reads a chunk from disk, must hold mutex
+func (s *chunkStore) load(filename string, chunkNum uint32) storedChunk {
+	var chunk storedChunk
+	data, err := ioutil.ReadFile(s.chunkPath(filename, chunkNum))
+	if err != nil || json.Unmarshal(data, &chunk) != nil {
+		return storedChunk{}
+	}
+	return chunk
+}
+
+// Saves a version of a chunk unless a later one is stored
+func (s *chunkStore) put(filename string, chunkNum uint32, version int, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.load(filename, chunkNum).Version >= version {
+		return nil
+	}
+	encoded, err := json.Marshal(storedChunk{Version: version, Data: data})
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(s.fileDir(filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a partial chunk
+	path := s.chunkPath(filename, chunkNum)
+	err = ioutil.WriteFile(path+".tmp", encoded, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Drops every chunk of a removed file
+func (s *chunkStore) remove(filename string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return os.RemoveAll(s.fileDir(filename))
+}
+
+// Moves the chunks of a renamed file to its new name
+func (s *chunkStore) rename(filename string, newName string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	os.RemoveAll(s.fileDir(newName))
+	err := os.Rename(s.fileDir(filename), s.fileDir(newName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Returns the stored copy of a chunk if it is a version the caller may read
+// A READ that isn't opening the file needs the latest version, like from a client
+func (d *DFSServerInstance) storedChunk(args *shared.Args) (data []byte, vers int, err error) {
+	if d.Store == nil {
+		return nil, 0, errors.New("Error because no clients found.")
+	}
+	d.mutex.RLock()
+	latest := d.FileVersions[args.Filename][args.Chunknum]
+	d.mutex.RUnlock()
+
+	vers, data = d.Store.get(args.Filename, args.Chunknum)
+	if vers == 0 || (args.Mode == int(READ) && !args.Open && vers != latest) {
+		return nil, 0, errors.New("Error because no clients found.")
+	}
+	return data, vers, nil
+}
+
+// Returns true if the store holds the latest version of every chunk written to filename
+func (d *DFSServerInstance) storedLatest(filename string) bool {
+	for chunkNum, version := range d.FileVersions[filename] {
+		if stored, _ := d.Store.get(filename, chunkNum); stored != version {
+			return false
+		}
+	}
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////////////////////////
+// <CHUNK REPLICAS>
+
+// New chunk version to copy to other clients
+type chunkPush struct {
+	filename string
+	chunkNum uint32
+	version  int
+	data     []byte // nil for repairs, the data is fetched when the push is made
+	repair   bool   // True if queued by repairReplicas
+}
+
+// Chunk version, the key of repairs queued
+type chunkVersion struct {
+	filename string
+	chunkNum uint32
+	version  int
+}
+
+// Progress of the repairs bringing chunks back to the replication factor
+type repairs struct {
+	mutex       sync.Mutex
+	queued      map[chunkVersion]bool // Repairs waiting in the push queue
+	backlog     int                   // Chunks below the replication factor at the last scan
+	unavailable int                   // Chunks among them no live client or chunk store holds
+	repaired    int                   // Copies made by repairs since the server started
+	failed      int                   // Repairs that could not fetch the chunk or push it anywhere
+	lastScan    time.Time
+}
+
+func newRepairs() *repairs {
+	return &repairs{queued: make(map[chunkVersion]bool)}
+}
+
+// Queues a chunk version to be pushed to other clients
+// The push is dropped if the queue is full, the chunk then shows up as under-replicated
+func (d *DFSServerInstance) queuePush(push chunkPush) {
+	select {
+	case d.pushes <- push:
+	default:
+	}
+}
+
+// Pushes queued chunk versions one at a time, so a client never gets
+// an older version of a chunk after a newer one
+func (d *DFSServerInstance) pushReplicas() {
+	for push := range d.pushes {
+		copies, err := d.pushChunk(push)
+		if push.repair {
+			d.repairs.done(push, copies, err)
+		}
+	}
+}
+
+// Returns true if client is connected and its heartbeat arrived in the last heartbeatTimeout, must hold mutex
+// Clients are only marked disconnected when a late heartbeat arrives, one that stopped sending is not live
+func (d *DFSServerInstance) live(client string) bool {
+	received, exists := d.HeartbeatReceived[client]
+	return exists && time.Since(received) <= heartbeatTimeout &&
+		d.ConnectedClients[client] == "Connected" && d.Clients[client] != nil
+}
+
+// Returns the clients among holders that are live, must hold mutex
+func (d *DFSServerInstance) liveClients(holders []string) []string {
+	var live []string
+	for _, client := range holders {
+		if d.live(client) {
+			live = append(live, client)
+		}
+	}
+	return live
+}
+
+// Returns the clients holding version vers of chunkNum, connected or not, must hold mutex
+func (d *DFSServerInstance) replicaHolders(filename string, chunkNum uint32, vers int) []string {
+	var holders []string
+	for _, client := range d.Files[filename] {
+		for _, file := range d.ClientFiles[client] {
+			if file.Name == filename && file.Versions[chunkNum] == vers {
+				holders = append(holders, client)
+				break
+			}
+		}
+	}
+	return holders
+}
+
+// Returns the live clients a chunk version can be pushed to, must hold mutex
+// Clients that already have the file come first
+func (d *DFSServerInstance) pushTargets(filename string, holders []string) []string {
+	var others []string
+	for client := range d.ConnectedClients {
+		if d.live(client) && !contains(d.Files[filename], client) {
+			others = append(others, client)
+		}
+	}
+	sort.Strings(others)
+
+	var targets []string
+	for _, client := range append(append([]string(nil), d.Files[filename]...), others...) {
+		if d.live(client) && !contains(holders, client) {
+			targets = append(targets, client)
+		}
+	}
+	return targets
+}
+
+// Copies a chunk version to live clients until Replicas clients besides its writer hold it
+// Versions already overwritten are skipped, the newer one is queued behind
+// Returns the copies made, and an error if more were needed but could not be made
+func (d *DFSServerInstance) pushChunk(push chunkPush) (copies int, err error) {
+	d.mutex.RLock()
+	if d.FileVersions[push.filename][push.chunkNum] != push.version {
+		d.mutex.RUnlock()
+		return 0, nil
+	}
+	holders := d.liveClients(d.replicaHolders(push.filename, push.chunkNum, push.version))
+	missing := d.Replicas + 1 - len(holders)
+	targets := d.pushTargets(push.filename, holders)
+	chunkSize := d.ChunkSizes[push.filename]
+	conns := make(map[string]*rpc.Client)
+	for _, client := range append(targets, holders...) {
+		conns[client] = d.Clients[client]
+	}
+	d.mutex.RUnlock()
+	if missing <= 0 {
+		return 0, nil
+	}
+
+	// Repairs copy the chunk from the store or a live holder
+	if push.data == nil {
+		push.data, err = d.fetchChunk(push, chunkSize, holders, conns)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for _, client := range targets {
+		if missing <= 0 {
+			return copies, nil
+		}
+		args := &shared.Args{
+			Filename:  push.filename,
+			LocalPath: client,
+			Chunknum:  push.chunkNum,
+			Version:   push.version,
+			ChunkSize: chunkSize,
+			Data:      push.data,
+		}
+		err := callClient(conns[client], "ClientInstance.StoreChunk", args, new(shared.Reply))
+		if err != nil {
+			continue
+		}
+		if d.recordReplica(client, push.filename, push.chunkNum, push.version, chunkSize) {
+			missing--
+			copies++
+		}
+	}
+	if missing > 0 {
+		return copies, errors.New("Error because too few clients are live.")
+	}
+	return copies, nil
+}
+
+// Returns the data of a chunk version from the chunk store or one of holders
+func (d *DFSServerInstance) fetchChunk(push chunkPush, chunkSize int, holders []string, conns map[string]*rpc.Client) ([]byte, error) {
+	if d.Store != nil {
+		if version, data := d.Store.get(push.filename, push.chunkNum); version == push.version {
+			return data, nil
+		}
+	}
+	for _, client := range holders {
+		var reply shared.Reply
+		args := &shared.Args{
+			Filename:    push.filename,
+			LocalPath:   client,
+			BytesToRead: chunkSize,
+			Offset:      int(push.chunkNum) * chunkSize,
+		}
+		err := callClient(conns[client], "ClientInstance.GetChunk", args, &reply)
+		if err == nil {
+			return reply.Data, nil
+		}
+	}
+	return nil, errors.New("Error because no clients found.")
+}
+
+// Calls method on a client, giving up after pushTimeout so one hung client doesn't stall every push
+// reply is only filled in if the call returns in time
+func callClient(conn *rpc.Client, method string, args *shared.Args, reply *shared.Reply) error {
+	call := conn.Go(method, args, new(shared.Reply), make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == nil {
+			*reply = *call.Reply.(*shared.Reply)
+		}
+		return call.Error
+	case <-time.After(pushTimeout):
+		return errors.New("Error because the client didn't reply in time.")
+	}
+}
+
+// Records that client holds version of chunkNum after a push
+// Returns false if the client unmounted, or if the file was removed or renamed meanwhile and its copy on the client is dropped
+func (d *DFSServerInstance) recordReplica(localPath string, filename string, chunkNum uint32, version int, chunkSize int) bool {
+	d.mutex.Lock()
+	clientInfo, mounted := d.ClientInfo[localPath]
+	if !mounted {
+		d.mutex.Unlock()
+		return false
+	}
+	if _, exists := d.FileVersions[filename]; !exists {
+		conn := d.Clients[localPath]
+		d.mutex.Unlock()
+		if conn != nil {
+			args := &shared.Args{
+				LocalPath: localPath,
+				Filename:  filename,
+			}
+			conn.Go("ClientInstance.ApplyNamespaceChange", args, new(shared.Reply), nil)
+		}
+		return false
+	}
+	defer d.mutex.Unlock()
+
+	// Add the file to the client's list if it didn't have it
+	files := clientInfo.Files
+	index := -1
+	for i, f := range files {
+		if f.Name == filename {
+			index = i
+		}
+	}
+	if index < 0 {
+		files = append(files, &shared.FileMetadata{
+			Name:      filename,
+			Versions:  make(map[uint32]int),
+			ChunkSize: chunkSize,
+		})
+		index = len(files) - 1
+	}
+	file := files[index]
+	if file.Versions[chunkNum] >= version {
+		return true
+	}
+	versions := shared.CopyVersions(file.Versions)
+	versions[chunkNum] = version
+	files[index] = &shared.FileMetadata{
+		Name:      file.Name,
+		Versions:  versions,
+		ChunkSize: file.ChunkSize,
+	}
+	d.ClientInfo[localPath] = &shared.ClientMetadata{
+		ID:        clientInfo.ID,
+		Addr:      clientInfo.Addr,
+		LocalPath: clientInfo.LocalPath,
+		UUID:      clientInfo.UUID,
+		Files:     files,
+	}
+	d.ClientFiles[localPath] = files
+	if !contains(d.Files[filename], localPath) {
+		d.Files[filename] = append(d.Files[filename], localPath)
+	}
+	d.logChanges([]string{filename}, []string{localPath}, nil)
+	return true
+}
+
+// Returns the chunks whose latest version is held by fewer live clients than
+// the replication factor asks for, sorted by file and chunk number
+func (d *DFSServerInstance) UnderReplicated(args *shared.Args, reply *shared.Reply) (err error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	reply.Replicas = d.underReplicated()
+	return nil
+}
+
+// Returns the chunks with fewer live copies than the replication factor, must hold mutex
+func (d *DFSServerInstance) underReplicated() []shared.ChunkReplicas {
+	var names []string
+	for filename := range d.FileVersions {
+		names = append(names, filename)
+	}
+	sort.Strings(names)
+
+	var under []shared.ChunkReplicas
+	for _, filename := range names {
+		var chunks []uint32
+		for chunkNum, version := range d.FileVersions[filename] {
+			if version > 0 {
+				chunks = append(chunks, chunkNum)
+			}
+		}
+		sort.Slice(chunks, func(i, j int) bool {
+			return chunks[i] < chunks[j]
+		})
+		for _, chunkNum := range chunks {
+			version := d.FileVersions[filename][chunkNum]
+			holders := d.replicaHolders(filename, chunkNum, version)
+			live := d.liveClients(holders)
+			if len(live) < d.Replicas+1 {
+				under = append(under, shared.ChunkReplicas{
+					Filename: filename,
+					Chunknum: chunkNum,
+					Version:  version,
+					Replicas: len(holders),
+					Live:     len(live),
+				})
+			}
+		}
+	}
+	return under
+}
+
+// Looks for chunks with fewer live copies than the replication factor every repairInterval,
+// and queues them to be copied to other clients from a live holder or the chunk store
+func (d *DFSServerInstance) repairReplicas() {
+	for {
+		time.Sleep(repairInterval)
+
+		d.mutex.RLock()
+		under := d.underReplicated()
+		var repairable []chunkPush
+		unavailable := 0
+		for _, chunk := range under {
+			stored := false
+			if d.Store != nil {
+				version, _ := d.Store.get(chunk.Filename, chunk.Chunknum)
+				stored = version == chunk.Version
+			}
+			if chunk.Live == 0 && !stored {
+				// Nothing to copy from until a holder comes back
+				unavailable++
+				continue
+			}
+			live := d.liveClients(d.replicaHolders(chunk.Filename, chunk.Chunknum, chunk.Version))
+			if len(d.pushTargets(chunk.Filename, live)) == 0 {
+				// Nowhere to copy to until another client mounts
+				continue
+			}
+			repairable = append(repairable, chunkPush{
+				filename: chunk.Filename,
+				chunkNum: chunk.Chunknum,
+				version:  chunk.Version,
+				repair:   true,
+			})
+		}
+		d.mutex.RUnlock()
+
+		d.repairs.mutex.Lock()
+		d.repairs.backlog = len(under)
+		d.repairs.unavailable = unavailable
+		d.repairs.lastScan = time.Now()
+		var queue []chunkPush
+		for _, push := range repairable {
+			key := chunkVersion{push.filename, push.chunkNum, push.version}
+			if !d.repairs.queued[key] {
+				d.repairs.queued[key] = true
+				queue = append(queue, push)
+			}
+		}
+		d.repairs.mutex.Unlock()
+
+		// Repairs that don't fit in the queue are left for the next scan, so new writes still find room
+		for i, push := range queue {
+			select {
+			case d.pushes <- push:
+				continue
+			default:
+			}
+			d.repairs.mutex.Lock()
+			for _, dropped := range queue[i:] {
+				delete(d.repairs.queued, chunkVersion{dropped.filename, dropped.chunkNum, dropped.version})
+			}
+			d.repairs.mutex.Unlock()
+			break
+		}
+	}
+}
+
+// Records the outcome of a repair taken off the push queue
+func (r *repairs) done(push chunkPush, copies int, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.queued, chunkVersion{push.filename, push.chunkNum, push.version})
+	r.repaired += copies
+	if err != nil {
+		r.failed++
+	}
+}
+
+// Returns how far repairs are from bringing every chunk back to the replication factor
+func (d *DFSServerInstance) RepairStatus(args *shared.Args, reply *shared.Reply) (err error) {
+	if d.repairs == nil {
+		return nil
+	}
+	d.repairs.mutex.Lock()
+	defer d.repairs.mutex.Unlock()
+	reply.Repairs = shared.RepairMetrics{
+		Backlog:     d.repairs.backlog,
+		Unavailable: d.repairs.unavailable,
+		Queued:      len(d.repairs.queued),
+		Repaired:    d.repairs.repaired,
+		Failed:      d.repairs.failed,
+		LastScan:    d.repairs.lastScan,
+	}
+	return nil
+}
@@ -3,17 +3,31 @@ package shared
 import "time"
 
 type Args struct {
-	LocalPath   string
-	Addr        string
-	Filename    string
-	Version     int
-	BytesToRead int
-	Offset      int
-	Versions    [256]int
-	Mode        int
-	Chunknum    uint8
-	ServerAddr  string
-	Open        bool
+	LocalPath    string
+	Addr         string
+	Filename     string
+	Version      int
+	BytesToRead  int
+	Offset       int
+	Versions     map[uint32]int
+	Mode         int
+	Chunknum     uint32
+	ChunkSize    int
+	ServerAddr   string
+	Open         bool
+	NewName      string
+	Prefix       string
+	After        string
+	Limit        int
+	Writer       string
+	Epoch        int
+	Ticket       uint64
+	LastChunk    uint32
+	Servers      []string
+	Data         []byte
+	Disconnected bool
+	UUID         string
+	Files        []*FileMetadata
 }
 
 // Reply struct
@@ -24,9 +38,21 @@ type Reply struct {
 	Connected bool
 	Filename  string
 	Version   int
-	Versions  [256]int
-	Chunk     [32]byte
+	Versions  map[uint32]int
+	Data      []byte
+	ChunkSize int
 	Writeable bool
+	Entries   []DirEntry
+	Changes   []NamespaceChange
+	Holders   map[string]map[uint32]int
+	Writer    string
+	Names     []string
+	Epoch     int           // Epoch of the write lease granted
+	Lease     time.Duration // How long the write lease lasts unless renewed
+	Servers   []string      // Addresses of the primary and backup servers, primary first
+	Replicas  []ChunkReplicas
+	Repairs   RepairMetrics
+	Conflict  bool // True if a disconnected write was refused because the chunk changed since
 }
 
 type Heartbeat struct {
@@ -36,9 +62,41 @@ type Heartbeat struct {
 
 // Information about Files
 type FileMetadata struct {
-	Name     string            //Name of file
-	Versions [256]int          //Version of each chunk
-	Access   map[string]string //Record client writing to file writing
+	Name      string            //Name of file
+	Versions  map[uint32]int    //Version of each chunk written, missing chunks are version 0
+	ChunkSize int               //Bytes per chunk, fixed when the file is created
+	Access    map[string]string //Record client writing to file writing
+}
+
+// Entry of a directory listing
+type DirEntry struct {
+	Name  string //Name within the directory
+	IsDir bool   //True for directories, false for files
+}
+
+// Copies of the latest version of a chunk
+type ChunkReplicas struct {
+	Filename string //File the chunk belongs to
+	Chunknum uint32 //Chunk number in the file
+	Version  int    //Latest version of the chunk
+	Replicas int    //Clients holding the latest version
+	Live     int    //Clients holding the latest version that are connected and sending heartbeats
+}
+
+// Progress of the server's repairs of chunks below the replication factor
+type RepairMetrics struct {
+	Backlog     int       //Chunks below the replication factor at the last scan
+	Unavailable int       //Chunks among them with no live copy to repair from
+	Queued      int       //Repairs waiting to be made
+	Repaired    int       //Copies made by repairs since the server started
+	Failed      int       //Repairs that could not make every copy needed
+	LastScan    time.Time //When the server last looked for chunks to repair
+}
+
+// File removal or rename a client has to apply to its local copy
+type NamespaceChange struct {
+	Filename string //File removed or renamed
+	NewName  string //New name of a renamed file, "" if the file was removed
 }
 
 //Information about Client
@@ -47,6 +105,16 @@ type ClientMetadata struct {
 	Addr      string          //IP address of client
 	LocalPath string          //LocalPath of client
 	Files     []*FileMetadata //List of files that client has
+	UUID      string          //ID kept in the client's local path, the same on every mount
+}
+
+// Returns a copy of a chunk version map
+func CopyVersions(versions map[uint32]int) map[uint32]int {
+	copied := make(map[uint32]int, len(versions))
+	for chunkNum, version := range versions {
+		copied[chunkNum] = version
+	}
+	return copied
 }
 
 /*
@@ -0,0 +1,204 @@
+/*
+ * Stress test for concurrent use of the server. Build the server and this
+ * program with the race detector so unsynchronized access is reported:
+ *
+ * $ go run -race server.go 127.0.0.1:8080
+ * $ go run -race stress_app.go 127.0.0.1:8080 [clients] [rounds]
+ *
+ * Every round, all clients at the same time:
+ * - Open their own file for WRITING, write the chunk for the round and close it
+ * - Open every other client's file for READING and check the chunk written
+ * - Try to open file shared for WRITING; exactly one at a time may succeed,
+ *   the others must get OpenWriteConflictError
+ * - Stat and list files while the others are writing
+ */
+
+package main
+
+import (
+	"./dfslib"
+
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const sharedFile = "shared"
+
+// Counts failed checks across all clients
+type results struct {
+	mutex  sync.Mutex
+	failed int
+	ok     int
+}
+
+func (r *results) check(description string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err != nil {
+		r.failed++
+		fmt.Printf("ERROR %s: %v\n", description, err)
+	} else {
+		r.ok++
+	}
+}
+
+// Returns the content client i writes in round
+func content(i int, round int) []byte {
+	return []byte(fmt.Sprintf("client %d round %d", i, round))
+}
+
+// Returns the name of client i's own file
+func fileName(i int) string {
+	return fmt.Sprintf("stress%d", i)
+}
+
+func writeOwn(client dfslib.DFS, i int, round int, res *results) {
+	f, err := client.Open(fileName(i), dfslib.WRITE)
+	res.check(fmt.Sprintf("client %d open own file", i), err)
+	if err != nil {
+		return
+	}
+	var chunk dfslib.Chunk
+	copy(chunk[:], content(i, round))
+	res.check(fmt.Sprintf("client %d write chunk %d", i, round), f.Write(uint32(round), &chunk))
+	res.check(fmt.Sprintf("client %d close own file", i), f.Close())
+}
+
+func readOthers(client dfslib.DFS, i int, n int, round int, res *results) {
+	for j := 0; j < n; j++ {
+		if j == i {
+			continue
+		}
+		f, err := client.Open(fileName(j), dfslib.READ)
+		res.check(fmt.Sprintf("client %d open %s", i, fileName(j)), err)
+		if err != nil {
+			continue
+		}
+		var chunk dfslib.Chunk
+		err = f.Read(uint32(round), &chunk)
+		if err == nil && !bytes.HasPrefix(chunk[:], content(j, round)) {
+			err = fmt.Errorf("read %q", bytes.TrimRight(chunk[:], "\x00"))
+		}
+		res.check(fmt.Sprintf("client %d read %s chunk %d", i, fileName(j), round), err)
+		f.Close()
+	}
+}
+
+func contendShared(client dfslib.DFS, i int, round int, writers *counter, res *results) {
+	f, err := client.Open(sharedFile, dfslib.WRITE)
+	if _, conflict := err.(dfslib.OpenWriteConflictError); conflict {
+		return
+	}
+	res.check(fmt.Sprintf("client %d open %s", i, sharedFile), err)
+	if err != nil {
+		return
+	}
+	if writers.add(1) != 1 {
+		res.check(fmt.Sprintf("client %d open %s", i, sharedFile), fmt.Errorf("two clients hold write access"))
+	}
+	var chunk dfslib.Chunk
+	copy(chunk[:], content(i, round))
+	res.check(fmt.Sprintf("client %d write %s", i, sharedFile), f.Write(0, &chunk))
+	writers.add(-1)
+	res.check(fmt.Sprintf("client %d close %s", i, sharedFile), f.Close())
+}
+
+func inspect(client dfslib.DFS, i int, res *results) {
+	_, err := client.Stat(sharedFile)
+	if _, missing := err.(dfslib.FileNotFoundError); missing {
+		err = nil
+	}
+	res.check(fmt.Sprintf("client %d stat %s", i, sharedFile), err)
+	_, err = client.ListGlobalFiles("stress", "", 0)
+	res.check(fmt.Sprintf("client %d list files", i), err)
+	_, err = client.GlobalFileExists(fileName(i))
+	res.check(fmt.Sprintf("client %d global file exists", i), err)
+}
+
+// Number of clients holding write access to the shared file
+type counter struct {
+	mutex sync.Mutex
+	n     int
+}
+
+func (c *counter) add(delta int) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.n += delta
+	return c.n
+}
+
+// Runs f for every client at the same time and waits for all of them
+func all(clients []dfslib.DFS, f func(client dfslib.DFS, i int)) {
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+		go func(client dfslib.DFS, i int) {
+			defer wg.Done()
+			f(client, i)
+		}(client, i)
+	}
+	wg.Wait()
+}
+
+func main() {
+	if len(os.Args) < 2 || len(os.Args) > 4 {
+		fmt.Println("Usage: go run -race stress_app.go [server host:ip] [clients] [rounds]")
+		return
+	}
+	serverAddr := os.Args[1]
+	localIP := "127.0.0.1" // you may want to change this when testing
+	n, rounds := 8, 5
+	if len(os.Args) > 2 {
+		n, _ = strconv.Atoi(os.Args[2])
+	}
+	if len(os.Args) > 3 {
+		rounds, _ = strconv.Atoi(os.Args[3])
+	}
+
+	res := &results{}
+	clients := make([]dfslib.DFS, n)
+	for i := range clients {
+		localPath, err := ioutil.TempDir(".", fmt.Sprintf("stress%d", i))
+		if err != nil {
+			panic("Could not create temporary directory")
+		}
+		defer os.RemoveAll(localPath)
+		clients[i], err = dfslib.MountDFS(serverAddr, localIP, localPath)
+		if err != nil {
+			fmt.Println("Error: Could not mount client", i, err)
+			return
+		}
+	}
+
+	writers := &counter{}
+	for round := 0; round < rounds; round++ {
+		all(clients, func(client dfslib.DFS, i int) {
+			writeOwn(client, i, round, res)
+		})
+		all(clients, func(client dfslib.DFS, i int) {
+			readOthers(client, i, n, round, res)
+		})
+		all(clients, func(client dfslib.DFS, i int) {
+			if i%2 == 0 {
+				contendShared(client, i, round, writers, res)
+			} else {
+				inspect(client, i, res)
+			}
+		})
+		fmt.Printf("Round %d done\n", round)
+	}
+
+	all(clients, func(client dfslib.DFS, i int) {
+		res.check(fmt.Sprintf("client %d unmount", i), client.UMountDFS())
+	})
+
+	fmt.Printf("%d checks passed, %d failed\n", res.ok, res.failed)
+	if res.failed > 0 {
+		os.Exit(1)
+	}
+}